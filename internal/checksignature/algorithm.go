@@ -0,0 +1,148 @@
+package checksignature
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	algorithmField      = "algorithm"
+	publicKeysField     = "public_keys"
+	publicKeysFileField = "file"
+)
+
+// Signature algorithms.
+const (
+	algorithmSecp256k1 = "secp256k1"
+	algorithmEd25519   = "ed25519"
+	algorithmP256      = "p256"
+)
+
+var algorithmConfigField = service.NewStringAnnotatedEnumField(algorithmField, map[string]string{
+	algorithmSecp256k1: "Ethereum signatures, the signer address is recovered from the signature and compared to the subject.",
+	algorithmEd25519:   "Ed25519 signatures of the payload bytes, verified with the public key of the subject.",
+	algorithmP256:      "ECDSA NIST P-256 signatures of the SHA-256 digest of the payload, verified with the public key of the subject. Both raw `r || s` and ASN.1 DER signatures are accepted.",
+}).Description("Signature algorithm of the messages. `hash_scheme` and `erc1271` only apply to `" + algorithmSecp256k1 + "`.").
+	Default(algorithmSecp256k1)
+
+var publicKeysConfigField = service.NewObjectField(publicKeysField,
+	service.NewStringField(publicKeysFileField).
+		Description("Path to a JSON file that maps subject addresses to PEM encoded PKIX public keys.").
+		Example("./public_keys.json"),
+).Description("Public keys used to verify signatures when `algorithm` is not `" + algorithmSecp256k1 + "`.").Optional()
+
+// PublicKeyResolver returns the public key that signs for a subject.
+// Keys are ed25519.PublicKey or *ecdsa.PublicKey values.
+type PublicKeyResolver interface {
+	PublicKey(ctx context.Context, subject common.Address) (crypto.PublicKey, error)
+}
+
+// publicKeyVerifier verifies signatures that can not be recovered to an address against a resolved public key.
+type publicKeyVerifier struct {
+	algorithm string
+	resolver  PublicKeyResolver
+}
+
+// newPublicKeyVerifier creates a publicKeyVerifier for algorithm from the public_keys namespace of the processor config.
+func newPublicKeyVerifier(algorithm string, conf *service.ParsedConfig) (*publicKeyVerifier, error) {
+	path, err := conf.FieldString(publicKeysFileField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse file: %w", err)
+	}
+	resolver, err := newStaticPublicKeyResolver(path)
+	if err != nil {
+		return nil, err
+	}
+	return &publicKeyVerifier{algorithm: algorithm, resolver: resolver}, nil
+}
+
+// verify checks that signed was signed with the public key of its signer.
+func (p *publicKeyVerifier) verify(ctx context.Context, signed *signedMessage) error {
+	pub, err := p.resolver.PublicKey(ctx, signed.signer)
+	if err != nil {
+		return fmt.Errorf("failed to resolve public key for %s: %w", signed.signer, err)
+	}
+
+	switch p.algorithm {
+	case algorithmEd25519:
+		key, ok := pub.(ed25519.PublicKey)
+		if !ok {
+			return reject(reasonUnknownSigner, fmt.Errorf("public key of %s is not an ed25519 key", signed.signer))
+		}
+		if !ed25519.Verify(key, signed.payload, signed.signature) {
+			return reject(reasonInvalidSignature, fmt.Errorf("invalid ed25519 signature"))
+		}
+	case algorithmP256:
+		key, ok := pub.(*ecdsa.PublicKey)
+		if !ok || key.Curve != elliptic.P256() {
+			return reject(reasonUnknownSigner, fmt.Errorf("public key of %s is not a P-256 key", signed.signer))
+		}
+		digest := sha256.Sum256(signed.payload)
+		var valid bool
+		if len(signed.signature) == 64 {
+			r := new(big.Int).SetBytes(signed.signature[:32])
+			s := new(big.Int).SetBytes(signed.signature[32:])
+			valid = ecdsa.Verify(key, digest[:], r, s)
+		} else {
+			valid = ecdsa.VerifyASN1(key, digest[:], signed.signature)
+		}
+		if !valid {
+			return reject(reasonInvalidSignature, fmt.Errorf("invalid p256 signature"))
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", p.algorithm)
+	}
+	return nil
+}
+
+// staticPublicKeyResolver resolves public keys from a fixed mapping.
+type staticPublicKeyResolver struct {
+	keys map[common.Address]crypto.PublicKey
+}
+
+// newStaticPublicKeyResolver loads a JSON object mapping subject addresses to PEM encoded public keys.
+func newStaticPublicKeyResolver(path string) (*staticPublicKeyResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public keys file: %w", err)
+	}
+	var pemKeys map[common.Address]string
+	if err := json.Unmarshal(data, &pemKeys); err != nil {
+		return nil, fmt.Errorf("failed to parse public keys file: %w", err)
+	}
+
+	keys := make(map[common.Address]crypto.PublicKey, len(pemKeys))
+	for subject, pemKey := range pemKeys {
+		block, _ := pem.Decode([]byte(pemKey))
+		if block == nil {
+			return nil, fmt.Errorf("public key of %s is not PEM encoded", subject)
+		}
+		keys[subject], err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public key of %s: %w", subject, err)
+		}
+	}
+	return &staticPublicKeyResolver{keys: keys}, nil
+}
+
+// PublicKey returns the public key listed for subject.
+func (s *staticPublicKeyResolver) PublicKey(_ context.Context, subject common.Address) (crypto.PublicKey, error) {
+	key, ok := s.keys[subject]
+	if !ok {
+		return nil, reject(reasonUnknownSigner, fmt.Errorf("no public key for subject"))
+	}
+	return key, nil
+}
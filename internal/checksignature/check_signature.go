@@ -3,7 +3,13 @@ package checksignature
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/DIMO-Network/shared"
 	"github.com/ethereum/go-ethereum/common"
@@ -13,29 +19,179 @@ import (
 
 var zeroAddr common.Address
 
-const sigLen = 65
+const (
+	sigLen          = 65
+	pluginName      = "check_signature"
+	hashSchemeField = "hash_scheme"
+	modeField       = "mode"
+	workersField    = "workers"
+)
+
+// Verification modes.
+const (
+	modeReject   = "reject"
+	modeAnnotate = "annotate"
+)
+
+// Metadata keys set on messages in annotate mode.
+const (
+	metaSignatureValid   = "signature_valid"
+	metaRecoveredAddress = "signature_recovered_address"
+	metaSignatureError   = "signature_error"
+	metaRejectionReason  = "signature_rejection_reason"
+)
+
+var configSpec = service.NewConfigSpec().
+	Description("Validates the signature of a message.").
+	Field(service.NewStringAnnotatedEnumField(modeField, map[string]string{
+		modeReject: "Messages with an invalid signature fail with an error.",
+		modeAnnotate: "Every message passes through with the `" + metaSignatureValid + "`, `" + metaRecoveredAddress +
+			"`, `" + metaSignatureError + "` and `" + metaRejectionReason + "` metadata set from the verification result.",
+	}).Description("How the result of the verification is reported. In both modes rejected messages carry the `" +
+		metaRejectionReason + "` metadata and are counted by the `" + rejectedMetric + "` metric labeled by reason.").Default(modeReject)).
+	Field(algorithmConfigField).
+	Field(publicKeysConfigField).
+	Field(service.NewStringListField(hashSchemeField).
+		Description("Hash schemes to try, in order, when recovering the signer of the data. " +
+			"`raw` hashes the data bytes with keccak256, `eip191` hashes them as an EIP-191 personal message (personal_sign), " +
+			"`eip712` hashes the data object as EIP-712 typed data described by the `eip712` field.").
+		Default([]string{string(hashSchemeRaw)})).
+	Field(eip712ConfigField).
+	Field(erc1271ConfigField).
+	Field(signerConfigField).
+	Field(signatureConfigField).
+	Field(payloadConfigField).
+	Field(envelopeConfigField).
+	Field(canonicalizationConfigField).
+	Field(signersConfigField).
+	Field(replayConfigField).
+	Field(service.NewIntField(workersField).
+		Description("Number of messages of a batch that are verified concurrently. Zero uses one worker per CPU.").
+		Default(0).
+		Advanced())
 
 type signatureProcessor struct {
-	logger *service.Logger
+	logger      *service.Logger
+	hashSchemes []hashScheme
+	typedData   *typedDataHasher
+	erc1271     *erc1271Verifier
+	fields      messageFields
+	annotate    bool
+	workers     int
+	signers     *signerPolicy
+	replay      *replayGuard
+	publicKeys  *publicKeyVerifier
+	rejected    *service.MetricCounter
+	verified    *service.MetricCounter
 }
 
 func init() {
-	// Config spec is empty for now as we don't have any dynamic fields.
-	configSpec := service.NewConfigSpec().Description("Validates the signature of a message.")
-	constructor := func(_ *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
-		return newSignatureProcessor(mgr.Logger()), nil
+	constructor := func(cfg *service.ParsedConfig, mgr *service.Resources) (service.BatchProcessor, error) {
+		return ctor(cfg, mgr)
 	}
-	err := service.RegisterProcessor("check_signature", configSpec, constructor)
+	err := service.RegisterBatchProcessor(pluginName, configSpec, constructor)
 	if err != nil {
 		panic(err)
 	}
 }
 
+func ctor(cfg *service.ParsedConfig, mgr *service.Resources) (*signatureProcessor, error) {
+	schemeNames, err := cfg.FieldStringList(hashSchemeField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hash scheme field: %w", err)
+	}
+	if len(schemeNames) == 0 {
+		return nil, fmt.Errorf("at least one hash scheme must be set")
+	}
+	schemes := make([]hashScheme, len(schemeNames))
+	for i, name := range schemeNames {
+		schemes[i], err = parseHashScheme(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mode, err := cfg.FieldString(modeField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mode field: %w", err)
+	}
+	workers, err := cfg.FieldInt(workersField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse workers field: %w", err)
+	}
+	if workers < 0 {
+		return nil, fmt.Errorf("workers must not be negative")
+	}
+
+	proc := newSignatureProcessor(mgr.Logger())
+	proc.rejected = mgr.Metrics().NewCounter(rejectedMetric, reasonLabel)
+	proc.verified = mgr.Metrics().NewCounter(verifiedMetric)
+	proc.hashSchemes = schemes
+	proc.annotate = mode == modeAnnotate
+	if workers > 0 {
+		proc.workers = workers
+	}
+	proc.fields, err = newMessageFields(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Contains(eip712Field) {
+		proc.typedData, err = newTypedDataHasher(cfg.Namespace(eip712Field))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse eip712 field: %w", err)
+		}
+	}
+	if slices.Contains(schemes, hashSchemeEIP712) && proc.typedData == nil {
+		return nil, fmt.Errorf("the eip712 field must be set when using the eip712 hash scheme")
+	}
+	if cfg.Contains(signersField) {
+		proc.signers, err = newSignerPolicy(cfg.Namespace(signersField))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse authorized signers field: %w", err)
+		}
+	}
+	if cfg.Contains(replayField) {
+		proc.replay, err = newReplayGuard(cfg.Namespace(replayField))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse replay protection field: %w", err)
+		}
+	}
+	algorithm, err := cfg.FieldString(algorithmField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse algorithm field: %w", err)
+	}
+	if algorithm != algorithmSecp256k1 {
+		if !cfg.Contains(publicKeysField) {
+			return nil, fmt.Errorf("the public_keys field must be set when using the %s algorithm", algorithm)
+		}
+		if cfg.Contains(erc1271Field) {
+			return nil, fmt.Errorf("the erc1271 field is only supported with the %s algorithm", algorithmSecp256k1)
+		}
+		if proc.signers != nil && len(proc.signers.resolvers) > 0 {
+			// Public keys are resolved for the subject, so no other signer can be verified.
+			return nil, fmt.Errorf("the authorized_signers file and url are only supported with the %s algorithm", algorithmSecp256k1)
+		}
+		proc.publicKeys, err = newPublicKeyVerifier(algorithm, cfg.Namespace(publicKeysField))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse public keys field: %w", err)
+		}
+	}
+	if cfg.Contains(erc1271Field) {
+		proc.erc1271, err = newERC1271Verifier(cfg.Namespace(erc1271Field))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse erc1271 field: %w", err)
+		}
+	}
+	return proc, nil
+}
+
 func newSignatureProcessor(lgr *service.Logger) *signatureProcessor {
 	// The logger will already be labelled with the
 	// identifier of this component within a config.
 	return &signatureProcessor{
-		logger: lgr,
+		logger:      lgr,
+		hashSchemes: []hashScheme{hashSchemeRaw},
+		workers:     runtime.GOMAXPROCS(0),
 	}
 }
 
@@ -44,31 +200,183 @@ type Event struct {
 	Signature string `json:"signature"`
 }
 
-func (s *signatureProcessor) Process(_ context.Context, msg *service.Message) (service.MessageBatch, error) {
-	// Extract the message payload as a byte slice.
-	payload, err := msg.AsBytes()
+// Process verifies the signature of a single message.
+func (s *signatureProcessor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	recAddr, err := s.verify(ctx, msg)
+	if !s.annotate {
+		if err != nil {
+			msg.MetaSet(metaRejectionReason, string(rejectionReasonOf(err)))
+			return nil, err
+		}
+		return []*service.Message{msg}, nil
+	}
+	s.annotateMessage(msg, recAddr, err)
+	return []*service.Message{msg}, nil
+}
+
+// ProcessBatch verifies the signatures of a batch concurrently.
+// Messages that fail verification are marked with their error unless in annotate mode.
+func (s *signatureProcessor) ProcessBatch(ctx context.Context, batch service.MessageBatch) ([]service.MessageBatch, error) {
+	batch = batch.Copy()
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(s.workers, len(batch)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				recAddr, err := s.verify(ctx, batch[i])
+				if s.annotate {
+					s.annotateMessage(batch[i], recAddr, err)
+				} else if err != nil {
+					batch[i].MetaSet(metaRejectionReason, string(rejectionReasonOf(err)))
+					batch[i].SetError(err)
+				}
+			}
+		}()
+	}
+	for i := range batch {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return []service.MessageBatch{batch}, nil
+}
+
+// annotateMessage sets the verification result as metadata on msg.
+func (s *signatureProcessor) annotateMessage(msg *service.Message, recAddr common.Address, err error) {
+	msg.MetaSet(metaSignatureValid, strconv.FormatBool(err == nil))
+	if recAddr != zeroAddr {
+		msg.MetaSet(metaRecoveredAddress, recAddr.Hex())
+	} else {
+		msg.MetaDelete(metaRecoveredAddress)
+	}
 	if err != nil {
-		return nil, err
+		msg.MetaSet(metaSignatureError, err.Error())
+		msg.MetaSet(metaRejectionReason, string(rejectionReasonOf(err)))
+	} else {
+		msg.MetaDelete(metaSignatureError)
+		msg.MetaDelete(metaRejectionReason)
 	}
+}
 
-	var event Event
-	err = json.Unmarshal(payload, &event)
+// verify checks the signature of msg and records the outcome in the processor metrics.
+func (s *signatureProcessor) verify(ctx context.Context, msg *service.Message) (common.Address, error) {
+	recAddr, err := s.verifyMessage(ctx, msg)
 	if err != nil {
-		fmt.Println(err)
-		return nil, err
+		if s.rejected != nil {
+			s.rejected.Incr(1, string(rejectionReasonOf(err)))
+		}
+	} else if s.verified != nil {
+		s.verified.Incr(1)
 	}
+	return recAddr, err
+}
 
-	addr := common.HexToAddress(event.Subject)
-	signature := common.FromHex(event.Signature)
-	hash := crypto.Keccak256Hash(event.Data)
+// verifyMessage checks the signature of msg and returns the first address recovered from the signature, if any.
+// A nil error means the signer accepted the signature and, if enabled, that it is not a replay.
+func (s *signatureProcessor) verifyMessage(ctx context.Context, msg *service.Message) (common.Address, error) {
+	signed, err := s.fields.extract(msg)
+	if err != nil {
+		return zeroAddr, err
+	}
+	recAddr, err := s.verifySigned(ctx, signed)
+	if err != nil || s.replay == nil {
+		return recAddr, err
+	}
+	return recAddr, s.replay.check(msg, signed)
+}
 
-	if recAddr, err := Ecrecover(hash.Bytes(), signature); err != nil {
-		return nil, fmt.Errorf("failed to recover an address: %w", err)
-	} else if recAddr != addr {
-		return nil, fmt.Errorf("recovered wrong address %s", recAddr)
+// verifySigned checks that the signature of signed was produced by an authorized signer.
+func (s *signatureProcessor) verifySigned(ctx context.Context, signed *signedMessage) (common.Address, error) {
+	if s.publicKeys != nil {
+		if s.signers.denies(signed.signer) {
+			return zeroAddr, reject(reasonDeniedSigner, fmt.Errorf("signer %s is denied", signed.signer))
+		}
+		if err := s.publicKeys.verify(ctx, signed); err != nil {
+			return zeroAddr, err
+		}
+		return signed.signer, nil
 	}
 
-	return []*service.Message{msg}, nil
+	// Try each configured scheme in turn, the first one that recovers an authorized signer wins.
+	hashes := make([]common.Hash, 0, len(s.hashSchemes))
+	recovered := make([]common.Address, 0, len(s.hashSchemes))
+	var errs []error
+	// The reason of the most specific failure seen. A denied signer wins over a failed signer lookup, which wins
+	// over a mismatched signer, which wins over an unrecoverable signature.
+	var reason rejectionReason
+	for _, scheme := range s.hashSchemes {
+		hash, err := scheme.hash(signed.payload, s.typedData)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to hash data with %s scheme: %w", scheme, err))
+			if reason == "" {
+				reason = reasonMalformedJSON
+			}
+			continue
+		}
+		hashes = append(hashes, hash)
+		recAddr, err := Ecrecover(hash.Bytes(), signed.signature)
+		if err != nil {
+			if s.erc1271 == nil {
+				return zeroAddr, reject(recoverFailureReason(signed.signature), fmt.Errorf("failed to recover an address: %w", err))
+			}
+			// Contract account signatures are often not recoverable, let the contract decide.
+			errs = append(errs, fmt.Errorf("failed to recover an address: %w", err))
+			if reason == "" {
+				reason = recoverFailureReason(signed.signature)
+			}
+			continue
+		}
+		recovered = append(recovered, recAddr)
+		ok, err := s.signers.authorized(ctx, signed.signer, recAddr)
+		if err != nil {
+			errs = append(errs, err)
+			if errReason := rejectionReasonOf(err); errReason == reasonDeniedSigner || reason != reasonDeniedSigner {
+				reason = errReason
+			}
+			continue
+		}
+		if ok {
+			return recAddr, nil
+		}
+		if reason != reasonDeniedSigner && reason != reasonSignerLookupFailed {
+			reason = reasonAddressMismatch
+		}
+	}
+
+	// The subject may be a smart contract account, ask it whether it accepts the signature.
+	if s.erc1271 != nil && !s.signers.denies(signed.signer) {
+		for _, hash := range hashes {
+			valid, err := s.erc1271.isValidSignature(ctx, signed.signer, hash, signed.signature)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if valid {
+				return firstOrZero(recovered), nil
+			}
+		}
+	}
+
+	if len(recovered) > 0 {
+		addrs := make([]string, len(recovered))
+		for i := range recovered {
+			addrs[i] = recovered[i].String()
+		}
+		errs = append([]error{fmt.Errorf("recovered wrong address %s", strings.Join(addrs, ", "))}, errs...)
+	}
+	if reason == "" {
+		reason = reasonError
+	}
+	return firstOrZero(recovered), reject(reason, errors.Join(errs...))
+}
+
+func firstOrZero(addrs []common.Address) common.Address {
+	if len(addrs) == 0 {
+		return zeroAddr
+	}
+	return addrs[0]
 }
 
 func (s *signatureProcessor) Close(_ context.Context) error {
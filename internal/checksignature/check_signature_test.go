@@ -1,9 +1,36 @@
 package checksignature
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	ethcrypto "github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
 	"github.com/redpanda-data/benthos/v4/public/service"
 	"github.com/stretchr/testify/require"
 )
@@ -56,3 +83,1728 @@ func TestSignatureProcessorInvalidSignature(t *testing.T) {
 	require.Equal(t, err.Error(), "failed to recover an address: invalid signature recovery id")
 	require.Len(t, result, 0)
 }
+
+func TestSignatureProcessorHashSchemes(t *testing.T) {
+	// Signatures produced by personal_sign with the well-known development key of 0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266.
+	const eip191Msg = `{
+		"data": {"timestamp":1709656316768},
+		"signature": "0x1c76b2a0aaedb40218055688325f8c4e66fa941b829e5c41a5f1a25dac739d70307f046b40c94d55d0ef4452fdf4ca1a70196b53b280a348a7d042662a80b0511c",
+		"subject": "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+	}`
+	// personal_sign over the raw JSON value, so a string payload includes its quotes.
+	const eip191StringMsg = `{
+		"data": "hello",
+		"signature": "0x5803167db27d66d840a696c1ef20d60bf42b4e7930d162a9e73f46d9bc3732592b59f32d20c43695e4de9fcd2350cd2842e5fe0d3efc3dd03d2d7a025e6180061c",
+		"subject": "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+	}`
+	const rawMsg = `{
+		"data": {"timestamp":1709656316768},
+		"signature": "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c",
+		"subject": "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"
+	}`
+
+	tests := []struct {
+		name            string
+		config          string
+		msg             string
+		expectErr       bool
+		expectConfigErr bool
+	}{
+		{
+			name:      "default scheme rejects personal_sign",
+			config:    ``,
+			msg:       eip191Msg,
+			expectErr: true,
+		},
+		{
+			name:   "eip191 scheme accepts personal_sign",
+			config: `hash_scheme: [eip191]`,
+			msg:    eip191Msg,
+		},
+		{
+			name:   "eip191 scheme accepts personal_sign of string data",
+			config: `hash_scheme: [eip191]`,
+			msg:    eip191StringMsg,
+		},
+		{
+			name:      "eip191 scheme rejects raw signature",
+			config:    `hash_scheme: [eip191]`,
+			msg:       rawMsg,
+			expectErr: true,
+		},
+		{
+			name:   "multiple schemes accept raw signature",
+			config: `hash_scheme: [raw, eip191]`,
+			msg:    rawMsg,
+		},
+		{
+			name:   "multiple schemes accept personal_sign",
+			config: `hash_scheme: [raw, eip191]`,
+			msg:    eip191Msg,
+		},
+		{
+			name:            "unknown scheme",
+			config:          `hash_scheme: [sha256]`,
+			expectConfigErr: true,
+		},
+		{
+			name:            "no schemes",
+			config:          `hash_scheme: []`,
+			expectConfigErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			if tt.expectConfigErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			result, err := proc.Process(context.Background(), service.NewMessage([]byte(tt.msg)))
+			if tt.expectErr {
+				require.Error(t, err)
+				require.Len(t, result, 0)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, result, 1)
+		})
+	}
+}
+
+func TestSignatureProcessorEIP712(t *testing.T) {
+	// Domain, types and signature from the example in the EIP-712 specification.
+	const config = `
+hash_scheme: [eip712]
+eip712:
+  domain:
+    name: Ether Mail
+    version: "1"
+    chain_id: 1
+    verifying_contract: "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+  primary_type: Mail
+  types:
+    Person:
+      - name: name
+        type: string
+      - name: wallet
+        type: address
+    Mail:
+      - name: from
+        type: Person
+      - name: to
+        type: Person
+      - name: contents
+        type: string
+`
+	const data = `{
+		"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+		"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+		"contents": "Hello, Bob!"
+	}`
+	const signature = "0x4355c47d63924e8a72e509b65029052eb6c299d53a04e167c5775fd466751c9d07299936d304c153f6443dfa05f40ff007d72911b6f72307f996231605b915621c"
+
+	tests := []struct {
+		name      string
+		config    string
+		msg       string
+		expectErr bool
+	}{
+		{
+			name:   "valid typed data signature",
+			config: config,
+			msg:    `{"data": ` + data + `, "signature": "` + signature + `", "subject": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"}`,
+		},
+		{
+			name:   "typed data tried after raw",
+			config: strings.Replace(config, "[eip712]", "[raw, eip712]", 1),
+			msg:    `{"data": ` + data + `, "signature": "` + signature + `", "subject": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"}`,
+		},
+		{
+			name:      "wrong signer",
+			config:    config,
+			msg:       `{"data": ` + data + `, "signature": "` + signature + `", "subject": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"}`,
+			expectErr: true,
+		},
+		{
+			name:      "tampered data",
+			config:    config,
+			msg:       `{"data": ` + strings.Replace(data, "Hello", "Bye", 1) + `, "signature": "` + signature + `", "subject": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"}`,
+			expectErr: true,
+		},
+		{
+			name:      "data does not match types",
+			config:    config,
+			msg:       `{"data": {"contents": 1}, "signature": "` + signature + `", "subject": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+
+			result, err := proc.Process(context.Background(), service.NewMessage([]byte(tt.msg)))
+			if tt.expectErr {
+				require.Error(t, err)
+				require.Len(t, result, 0)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, result, 1)
+		})
+	}
+}
+
+func TestSignatureProcessorEIP712Config(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "eip712 scheme without definition",
+			config: `hash_scheme: [eip712]`,
+		},
+		{
+			name: "undefined primary type",
+			config: `
+hash_scheme: [eip712]
+eip712:
+  domain:
+    name: DIMO
+  primary_type: Status
+  types:
+    Other:
+      - name: timestamp
+        type: uint64
+`,
+		},
+		{
+			name: "invalid verifying contract",
+			config: `
+hash_scheme: [eip712]
+eip712:
+  domain:
+    verifying_contract: not_an_address
+  primary_type: Status
+  types:
+    Status:
+      - name: timestamp
+        type: uint64
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			_, err = ctor(parsedConfig, service.MockResources())
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestTypedDataHasher(t *testing.T) {
+	const config = `
+eip712:
+  domain:
+    name: DIMO
+  primary_type: Reading
+  types:
+    Reading:
+      - name: amount
+        type: uint256
+      - name: delta
+        type: int8
+      - name: tags
+        type: bytes4[]
+`
+	const maxUint256 = "115792089237316195423570985008687907853269984665640564039457584007913129639935"
+	parsedConfig, err := configSpec.ParseYAML(config, nil)
+	require.NoError(t, err)
+	hasher, err := newTypedDataHasher(parsedConfig.Namespace(eip712Field))
+	require.NoError(t, err)
+	expected, err := hasher.hash([]byte(`{"amount": "0x` + strings.Repeat("f", 64) + `", "delta": -128, "tags": ["0x1626ba7e"]}`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		data      string
+		expectErr bool
+	}{
+		{name: "large integer keeps precision", data: `{"amount": ` + maxUint256 + `, "delta": -128, "tags": ["0x1626ba7e"]}`},
+		{name: "decimal string", data: `{"amount": "` + maxUint256 + `", "delta": -128, "tags": ["0x1626ba7e"]}`},
+		{name: "uint overflow", data: `{"amount": 1` + maxUint256 + `, "delta": -128, "tags": ["0x1626ba7e"]}`, expectErr: true},
+		{name: "fractional number", data: `{"amount": 1.5, "delta": -128, "tags": ["0x1626ba7e"]}`, expectErr: true},
+		{name: "wrong bytes length", data: `{"amount": 1, "delta": -128, "tags": ["0x1626ba"]}`, expectErr: true},
+		{name: "null array item", data: `{"amount": 1, "delta": -128, "tags": [null]}`, expectErr: true},
+		{name: "missing field", data: `{"amount": 1, "delta": -128}`, expectErr: true},
+		{name: "extra field", data: `{"amount": 1, "delta": -128, "tags": [], "other": 1}`, expectErr: true},
+		{name: "not an object", data: `[1]`, expectErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, err := hasher.hash([]byte(tt.data))
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, expected, hash)
+		})
+	}
+}
+
+// ownedWallet is a fake ERC-1271 contract account that accepts signatures from its owner
+// or any signature listed in accepted.
+type ownedWallet struct {
+	owner    common.Address
+	accepted [][]byte
+}
+
+// isValidSignatureABI is the ERC-1271 interface, used to check the calldata independently of packIsValidSignature.
+var isValidSignatureABI = func() abi.ABI {
+	parsed, err := abi.JSON(strings.NewReader(`[{"type":"function","name":"isValidSignature","stateMutability":"view",` +
+		`"inputs":[{"name":"hash","type":"bytes32"},{"name":"signature","type":"bytes"}],"outputs":[{"name":"","type":"bytes4"}]}]`))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}()
+
+// fakeContractCaller dispatches isValidSignature calls to fake contract accounts.
+type fakeContractCaller struct {
+	wallets map[common.Address]ownedWallet
+	err     error
+	calls   atomic.Int32
+}
+
+func (f *fakeContractCaller) CallContract(_ context.Context, call ethereum.CallMsg, _ *big.Int) ([]byte, error) {
+	f.calls.Add(1)
+	if f.err != nil {
+		return nil, f.err
+	}
+	data := call.Data
+	wallet, ok := f.wallets[*call.To]
+	if !ok {
+		// Calls to accounts without code succeed with no return data.
+		return nil, nil
+	}
+	method, err := isValidSignatureABI.MethodById(data)
+	if err != nil {
+		return nil, errors.New("execution reverted")
+	}
+	args, err := method.Inputs.Unpack(data[4:])
+	if err != nil {
+		return nil, fmt.Errorf("execution reverted: %w", err)
+	}
+	hash := args[0].([32]byte)
+	sig := args[1].([]byte)
+
+	valid := slices.ContainsFunc(wallet.accepted, func(b []byte) bool { return bytes.Equal(b, sig) })
+	if recAddr, err := Ecrecover(hash[:], sig); err == nil && recAddr == wallet.owner {
+		valid = true
+	}
+	if !valid {
+		return common.RightPadBytes([]byte{0xff, 0xff, 0xff, 0xff}, 32), nil
+	}
+	return common.RightPadBytes(erc1271MagicValue, 32), nil
+}
+
+func TestPackIsValidSignature(t *testing.T) {
+	hash := common.HexToHash("0x2a")
+	for _, sigLen := range []int{0, 1, 32, 65, 130} {
+		sig := bytes.Repeat([]byte{0x01}, sigLen)
+		expected, err := isValidSignatureABI.Pack("isValidSignature", hash, sig)
+		require.NoError(t, err)
+		require.Equal(t, expected, packIsValidSignature(hash, sig), "signature length %d", sigLen)
+	}
+}
+
+func TestSignatureProcessorERC1271(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+	owner := common.HexToAddress("0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61")
+	ownedAddr := common.HexToAddress("0x000000000000000000000000000000000000c0de")
+	otherAddr := common.HexToAddress("0x000000000000000000000000000000000000beef")
+	multiSig := bytes.Repeat([]byte{0x01}, 130)
+	caller := &fakeContractCaller{
+		wallets: map[common.Address]ownedWallet{
+			ownedAddr: {owner: owner, accepted: [][]byte{multiSig}},
+			otherAddr: {owner: common.HexToAddress("0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3")},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		caller      ContractCaller
+		subject     common.Address
+		signature   string
+		expectedErr string
+	}{
+		{
+			name:      "contract accepts owner signature",
+			caller:    caller,
+			subject:   ownedAddr,
+			signature: signature,
+		},
+		{
+			name:      "contract accepts non recoverable signature",
+			caller:    caller,
+			subject:   ownedAddr,
+			signature: hexutil.Encode(multiSig),
+		},
+		{
+			name:        "contract rejects signature",
+			caller:      caller,
+			subject:     otherAddr,
+			signature:   signature,
+			expectedErr: "recovered wrong address 0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61",
+		},
+		{
+			name:        "account without code",
+			caller:      caller,
+			subject:     common.HexToAddress("0x000000000000000000000000000000000000dead"),
+			signature:   signature,
+			expectedErr: "recovered wrong address 0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61",
+		},
+		{
+			name:        "rpc failure",
+			caller:      &fakeContractCaller{err: errors.New("connection refused")},
+			subject:     ownedAddr,
+			signature:   signature,
+			expectedErr: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proc := newSignatureProcessor(nil)
+			proc.erc1271 = &erc1271Verifier{caller: tt.caller}
+
+			msg := `{
+				"data": {"timestamp":1709656316768},
+				"signature": "` + tt.signature + `",
+				"subject": "` + tt.subject.Hex() + `"
+			}`
+			result, err := proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+			if tt.expectedErr != "" {
+				require.ErrorContains(t, err, tt.expectedErr)
+				require.Len(t, result, 0)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, result, 1)
+		})
+	}
+}
+
+func TestERC1271VerifierCache(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+	ownedAddr := common.HexToAddress("0x000000000000000000000000000000000000c0de")
+	eoa := common.HexToAddress("0x000000000000000000000000000000000000dead")
+	caller := &fakeContractCaller{
+		wallets: map[common.Address]ownedWallet{
+			ownedAddr: {owner: common.HexToAddress("0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61")},
+		},
+	}
+	parsedConfig, err := configSpec.ParseYAML(`
+erc1271:
+  rpc_url: http://localhost:8545
+`, nil)
+	require.NoError(t, err)
+	verifier, err := newERC1271Verifier(parsedConfig.Namespace(erc1271Field))
+	require.NoError(t, err)
+	verifier.caller = caller
+
+	sig := hexutil.MustDecode(signature)
+	hash := common.HexToHash("0x2a")
+	for range 3 {
+		valid, err := verifier.isValidSignature(context.Background(), ownedAddr, hash, sig)
+		require.NoError(t, err)
+		require.False(t, valid)
+	}
+	require.Equal(t, int32(1), caller.calls.Load())
+
+	// Any signature for an account without code is answered from the cache after the first call.
+	for i := range 3 {
+		valid, err := verifier.isValidSignature(context.Background(), eoa, common.BigToHash(big.NewInt(int64(i))), sig)
+		require.NoError(t, err)
+		require.False(t, valid)
+	}
+	require.Equal(t, int32(2), caller.calls.Load())
+
+	// Errors are not cached.
+	caller.err = errors.New("connection refused")
+	for range 2 {
+		_, err := verifier.isValidSignature(context.Background(), ownedAddr, common.HexToHash("0x2b"), sig)
+		require.Error(t, err)
+	}
+	require.Equal(t, int32(4), caller.calls.Load())
+}
+
+// erc1271OwnerContract returns the creation code of a minimal ERC-1271 account whose isValidSignature
+// accepts the 65 byte signatures of owner. Its runtime code is:
+//
+//	mstore(0x00, calldataload(0x04))                   // hash
+//	p := add(calldataload(0x24), 0x04)                 // signature length
+//	mstore(0x40, calldataload(add(p, 0x20)))           // r
+//	mstore(0x60, calldataload(add(p, 0x40)))           // s
+//	mstore(0x20, byte(0, calldataload(add(p, 0x60)))) // v
+//	pop(staticcall(gas(), 0x01, 0x00, 0x80, 0x80, 0x20))
+//	if eq(mload(0x80), owner) { mstore(0, shl(0xe0, 0x1626ba7e)) return(0, 0x20) }
+//	mstore(0, shl(0xe0, 0xffffffff)) return(0, 0x20)
+func erc1271OwnerContract(owner common.Address) []byte {
+	code := slices.Concat(
+		hexutil.MustDecode("0x600435600052602435600401806020013560405280604001356060526060013560001a602052602060806080600060015afa5060805173"),
+		owner.Bytes(),
+		hexutil.MustDecode("0x14605f5763ffffffff60e01b60005260206000f35b631626ba7e60e01b60005260206000f3"),
+	)
+	// Copy the runtime code to memory and return it.
+	creation := []byte{0x60, byte(len(code)), 0x80, 0x60, 0x0b, 0x60, 0x00, 0x39, 0x60, 0x00, 0xf3}
+	return append(creation, code...)
+}
+
+func TestERC1271VerifierSimulatedChain(t *testing.T) {
+	deployer, err := ethcrypto.GenerateKey()
+	require.NoError(t, err)
+	owner, err := ethcrypto.GenerateKey()
+	require.NoError(t, err)
+	stranger, err := ethcrypto.GenerateKey()
+	require.NoError(t, err)
+	deployerAddr := ethcrypto.PubkeyToAddress(deployer.PublicKey)
+
+	backend := simulated.NewBackend(types.GenesisAlloc{deployerAddr: {Balance: big.NewInt(1e18)}})
+	defer func() { require.NoError(t, backend.Close()) }()
+	client := backend.Client()
+	ctx := context.Background()
+
+	chainID, err := client.ChainID(ctx)
+	require.NoError(t, err)
+	gasPrice, err := client.SuggestGasPrice(ctx)
+	require.NoError(t, err)
+	tx, err := types.SignTx(types.NewTx(&types.LegacyTx{
+		Gas:      500_000,
+		GasPrice: gasPrice,
+		Data:     erc1271OwnerContract(ethcrypto.PubkeyToAddress(owner.PublicKey)),
+	}), types.LatestSignerForChainID(chainID), deployer)
+	require.NoError(t, err)
+	require.NoError(t, client.SendTransaction(ctx, tx))
+	backend.Commit()
+	receipt, err := client.TransactionReceipt(ctx, tx.Hash())
+	require.NoError(t, err)
+	require.Equal(t, types.ReceiptStatusSuccessful, receipt.Status)
+
+	hash := ethcrypto.Keccak256Hash([]byte("status"))
+	sign := func(key *ecdsa.PrivateKey) []byte {
+		sig, err := ethcrypto.Sign(hash.Bytes(), key)
+		require.NoError(t, err)
+		sig[64] += 27
+		return sig
+	}
+
+	tests := []struct {
+		name          string
+		account       common.Address
+		signature     []byte
+		expectedValid bool
+	}{
+		{
+			name:          "owner signature",
+			account:       receipt.ContractAddress,
+			signature:     sign(owner),
+			expectedValid: true,
+		},
+		{
+			name:      "other signature",
+			account:   receipt.ContractAddress,
+			signature: sign(stranger),
+		},
+		{
+			name:      "account without code",
+			account:   deployerAddr,
+			signature: sign(owner),
+		},
+	}
+
+	verifier := &erc1271Verifier{caller: client}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid, err := verifier.isValidSignature(ctx, tt.account, hash, tt.signature)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedValid, valid)
+		})
+	}
+}
+
+func TestRPCContractCaller(t *testing.T) {
+	contract := common.HexToAddress("0x000000000000000000000000000000000000c0de")
+	callData := packIsValidSignature(common.HexToHash("0x01"), []byte{0x02})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Method != "eth_call" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var args rpcCallArgs
+		var block string
+		if err := json.Unmarshal(req.Params[0], &args); err != nil || args.To == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.Unmarshal(req.Params[1], &block); err != nil || block != "latest" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if *args.To != contract {
+			_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"` + hexutil.Encode(args.Data[:4]) + `"}`))
+	}))
+	defer server.Close()
+
+	caller := &rpcContractCaller{url: server.URL, client: server.Client()}
+	ret, err := caller.CallContract(context.Background(), ethereum.CallMsg{To: &contract, Data: callData}, nil)
+	require.NoError(t, err)
+	require.Equal(t, erc1271MagicValue, ret)
+
+	other := common.HexToAddress("0x01")
+	_, err = caller.CallContract(context.Background(), ethereum.CallMsg{To: &other, Data: callData}, nil)
+	require.EqualError(t, err, "rpc error 3: execution reverted")
+}
+
+func TestSignatureProcessorFieldPaths(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+	const signer = "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"
+
+	tests := []struct {
+		name      string
+		config    string
+		msg       string
+		meta      map[string]string
+		expectErr bool
+	}{
+		{
+			name: "signer from source",
+			config: `
+signer: '${!json("source")}'
+`,
+			msg: `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "source": "` + signer + `", "subject": "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3"}`,
+		},
+		{
+			name: "everything from metadata",
+			config: `
+signer: '${!@signer}'
+signature: '${!@signature}'
+payload: '${!content()}'
+`,
+			msg:  `{"timestamp":1709656316768}`,
+			meta: map[string]string{"signer": signer, "signature": signature},
+		},
+		{
+			name: "signature from metadata",
+			config: `
+signature: '${!@signature}'
+`,
+			msg:  `{"data": {"timestamp":1709656316768}, "subject": "` + signer + `"}`,
+			meta: map[string]string{"signature": signature},
+		},
+		{
+			name: "missing signer metadata",
+			config: `
+signer: '${!@signer}'
+`,
+			msg:       `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "subject": "` + signer + `"}`,
+			expectErr: true,
+		},
+		{
+			name: "payload does not match signature",
+			config: `
+signer: '${!@signer}'
+signature: '${!@signature}'
+payload: '${!content()}'
+`,
+			msg:       `{"timestamp":1709656316769}`,
+			meta:      map[string]string{"signer": signer, "signature": signature},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+
+			msg := service.NewMessage([]byte(tt.msg))
+			for k, v := range tt.meta {
+				msg.MetaSet(k, v)
+			}
+			result, err := proc.Process(context.Background(), msg)
+			if tt.expectErr {
+				require.Error(t, err)
+				require.Len(t, result, 0)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, result, 1)
+		})
+	}
+}
+
+func TestSignatureProcessorAnnotateMode(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+
+	tests := []struct {
+		name              string
+		msg               string
+		expectedValid     string
+		expectedRecovered string
+		expectedErr       string
+	}{
+		{
+			name:              "valid signature",
+			msg:               `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "subject": "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"}`,
+			expectedValid:     "true",
+			expectedRecovered: "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61",
+		},
+		{
+			name:              "wrong signer",
+			msg:               `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "subject": "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3"}`,
+			expectedValid:     "false",
+			expectedRecovered: "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61",
+			expectedErr:       "recovered wrong address 0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61",
+		},
+		{
+			name:          "invalid json",
+			msg:           `not json`,
+			expectedValid: "false",
+			expectedErr:   "invalid character 'o' in literal null (expecting 'u')",
+		},
+	}
+
+	parsedConfig, err := configSpec.ParseYAML(`mode: annotate`, nil)
+	require.NoError(t, err)
+	proc, err := ctor(parsedConfig, service.MockResources())
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := proc.Process(context.Background(), service.NewMessage([]byte(tt.msg)))
+			require.NoError(t, err)
+			require.Len(t, result, 1)
+			require.NoError(t, result[0].GetError())
+
+			valid, ok := result[0].MetaGet(metaSignatureValid)
+			require.True(t, ok)
+			require.Equal(t, tt.expectedValid, valid)
+
+			recovered, ok := result[0].MetaGet(metaRecoveredAddress)
+			require.Equal(t, tt.expectedRecovered != "", ok)
+			require.Equal(t, tt.expectedRecovered, recovered)
+
+			errMsg, ok := result[0].MetaGet(metaSignatureError)
+			require.Equal(t, tt.expectedErr != "", ok)
+			require.Equal(t, tt.expectedErr, errMsg)
+		})
+	}
+}
+
+func TestSignatureProcessorProcessBatch(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+	valid := `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "subject": "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"}`
+	wrongSigner := `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "subject": "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3"}`
+
+	var batch service.MessageBatch
+	var expectedErrs []string
+	for i := range 100 {
+		switch i % 3 {
+		case 0:
+			batch = append(batch, service.NewMessage([]byte(valid)))
+			expectedErrs = append(expectedErrs, "")
+		case 1:
+			batch = append(batch, service.NewMessage([]byte(wrongSigner)))
+			expectedErrs = append(expectedErrs, "recovered wrong address 0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61")
+		default:
+			batch = append(batch, service.NewMessage([]byte(`not json`)))
+			expectedErrs = append(expectedErrs, "invalid character 'o' in literal null (expecting 'u')")
+		}
+	}
+
+	for _, workers := range []int{1, 4, 200} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			proc := newSignatureProcessor(nil)
+			proc.workers = workers
+
+			result, err := proc.ProcessBatch(context.Background(), batch)
+			require.NoError(t, err)
+			require.Len(t, result, 1)
+			require.Len(t, result[0], len(batch))
+			for i, msg := range result[0] {
+				if expectedErrs[i] == "" {
+					require.NoError(t, msg.GetError(), "message %d", i)
+				} else {
+					require.EqualError(t, msg.GetError(), expectedErrs[i], "message %d", i)
+				}
+				// The input batch must not be modified.
+				require.NoError(t, batch[i].GetError())
+			}
+		})
+	}
+}
+
+func BenchmarkSignatureProcessor(b *testing.B) {
+	msg := []byte(`{
+		"data": {"timestamp":1709656316768},
+		"signature": "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c",
+		"subject": "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"
+	}`)
+	batch := make(service.MessageBatch, 256)
+	for i := range batch {
+		batch[i] = service.NewMessage(msg)
+	}
+	proc := newSignatureProcessor(nil)
+
+	b.Run("process", func(b *testing.B) {
+		for range b.N {
+			for _, m := range batch {
+				if _, err := proc.Process(context.Background(), m); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		b.ReportMetric(float64(b.N*len(batch))/b.Elapsed().Seconds(), "msgs/s")
+	})
+	b.Run("process_batch", func(b *testing.B) {
+		for range b.N {
+			if _, err := proc.ProcessBatch(context.Background(), batch); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*len(batch))/b.Elapsed().Seconds(), "msgs/s")
+	})
+}
+
+func TestSignatureProcessorAuthorizedSigners(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+	const signer = "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"
+	const fileSubject = "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3"
+	const httpSubject = "0x06fF8E7A4A159EA388da7c133DC5F79727868d83"
+	const unknownSubject = "0x000000000000000000000000000000000000dEaD"
+	const slowSubject = "0x0000000000000000000000000000000000005105"
+
+	signersFile := filepath.Join(t.TempDir(), "signers.json")
+	err := os.WriteFile(signersFile, []byte(`{"`+fileSubject+`": ["`+signer+`"]}`), 0o600)
+	require.NoError(t, err)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if strings.EqualFold(r.URL.Path, "/subjects/"+slowSubject+"/signers") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		if !strings.EqualFold(r.URL.Path, "/subjects/"+httpSubject+"/signers") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`["` + signer + `"]`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		config      string
+		subject     string
+		expectedErr string
+	}{
+		{
+			name:    "signer listed in file",
+			config:  "authorized_signers:\n  file: " + signersFile,
+			subject: fileSubject,
+		},
+		{
+			name:    "signer returned by url",
+			config:  "authorized_signers:\n  url: " + server.URL + "/subjects/{subject}/signers",
+			subject: httpSubject,
+		},
+		{
+			name:        "subject unknown to url",
+			config:      "authorized_signers:\n  url: " + server.URL + "/subjects/{subject}/signers",
+			subject:     unknownSubject,
+			expectedErr: "recovered wrong address " + signer,
+		},
+		{
+			name:    "url without cache",
+			config:  "authorized_signers:\n  url: " + server.URL + "/subjects/{subject}/signers\n  cache_ttl: 0s",
+			subject: httpSubject,
+		},
+		{
+			name:        "url timeout",
+			config:      "authorized_signers:\n  url: " + server.URL + "/subjects/{subject}/signers\n  timeout: 50ms",
+			subject:     slowSubject,
+			expectedErr: "Client.Timeout exceeded",
+		},
+		{
+			name:        "subject not listed in file",
+			config:      "authorized_signers:\n  file: " + signersFile,
+			subject:     unknownSubject,
+			expectedErr: "recovered wrong address " + signer,
+		},
+		{
+			name:    "subject signs for itself",
+			config:  "authorized_signers:\n  file: " + signersFile,
+			subject: signer,
+		},
+		{
+			name:        "denied signer",
+			config:      "authorized_signers:\n  file: " + signersFile + "\n  deny: [\"" + signer + "\"]",
+			subject:     signer,
+			expectedErr: "signer " + signer + " is denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+
+			msg := `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "subject": "` + tt.subject + `"}`
+			// Process twice to exercise any caching.
+			for range 2 {
+				result, err := proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+				if tt.expectedErr != "" {
+					require.ErrorContains(t, err, tt.expectedErr)
+					continue
+				}
+				require.NoError(t, err)
+				require.Len(t, result, 1)
+			}
+		})
+	}
+	// Each cached url test resolves its subject once, the second message is served from the cache.
+	// The uncached and the timed out tests resolve it for both messages.
+	require.Equal(t, int32(6), requests.Load())
+}
+
+func TestSignatureProcessorReplayProtection(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+	const subject = "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"
+	now := time.Date(2024, 3, 5, 16, 31, 56, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		config       string
+		messageTimes []string
+		expectedErrs []string
+	}{
+		{
+			name:         "duplicate message",
+			config:       "replay_protection: {}",
+			messageTimes: []string{now.Format(time.RFC3339), now.Format(time.RFC3339)},
+			expectedErrs: []string{"", "message was already verified"},
+		},
+		{
+			name:         "within clock skew",
+			config:       "replay_protection:\n  max_clock_skew: 5m",
+			messageTimes: []string{now.Add(-4 * time.Minute).Format(time.RFC3339)},
+			expectedErrs: []string{""},
+		},
+		{
+			name:         "outside of clock skew",
+			config:       "replay_protection:\n  max_clock_skew: 5m",
+			messageTimes: []string{now.Add(6 * time.Minute).Format(time.RFC3339)},
+			expectedErrs: []string{"outside of the allowed clock skew"},
+		},
+		{
+			name:         "invalid timestamp",
+			config:       "replay_protection:\n  max_clock_skew: 5m\n  timestamp: ${!json(\"data.timestamp\")}",
+			messageTimes: []string{now.Format(time.RFC3339)},
+			expectedErrs: []string{"invalid timestamp format"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+			proc.replay.now = func() time.Time { return now }
+
+			for i, msgTime := range tt.messageTimes {
+				msg := `{"data": {"timestamp":1709656316768}, "time": "` + msgTime + `", "signature": "` + signature + `", "subject": "` + subject + `"}`
+				_, err := proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+				if tt.expectedErrs[i] != "" {
+					require.ErrorContains(t, err, tt.expectedErrs[i])
+					continue
+				}
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSignatureProcessorReplayProtectionConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		expectedErr string
+	}{
+		{
+			name:        "zero ttl",
+			config:      "replay_protection:\n  ttl: 0s",
+			expectedErr: "ttl must be positive",
+		},
+		{
+			name:        "negative ttl",
+			config:      "replay_protection:\n  ttl: -1m",
+			expectedErr: "ttl must be positive",
+		},
+		{
+			name:        "zero max entries",
+			config:      "replay_protection:\n  max_entries: 0",
+			expectedErr: "max entries must be positive",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			_, err = ctor(parsedConfig, service.MockResources())
+			require.ErrorContains(t, err, tt.expectedErr)
+		})
+	}
+}
+
+func TestSignatureProcessorReplayMalleatedSignature(t *testing.T) {
+	const payload = `{"timestamp":1709656316768}`
+
+	t.Run("secp256k1 high s", func(t *testing.T) {
+		const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+		const subject = "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"
+		sig := hexutil.MustDecode(signature)
+		// (r, n-s, v^1) recovers the same signer.
+		highS := new(big.Int).Sub(ethcrypto.S256().Params().N, new(big.Int).SetBytes(sig[32:64]))
+		malleated := append(append(bytes.Clone(sig[:32]), highS.FillBytes(make([]byte, 32))...), sig[64]^1)
+
+		// A signer that does not normalize s is still accepted.
+		parsedConfig, err := configSpec.ParseYAML("", nil)
+		require.NoError(t, err)
+		proc, err := ctor(parsedConfig, service.MockResources())
+		require.NoError(t, err)
+		msg := `{"data": ` + payload + `, "signature": "` + hexutil.Encode(malleated) + `", "subject": "` + subject + `"}`
+		_, err = proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+		require.NoError(t, err)
+
+		parsedConfig, err = configSpec.ParseYAML("replay_protection: {}", nil)
+		require.NoError(t, err)
+		proc, err = ctor(parsedConfig, service.MockResources())
+		require.NoError(t, err)
+		for i, candidate := range [][]byte{sig, malleated} {
+			msg := `{"data": ` + payload + `, "signature": "` + hexutil.Encode(candidate) + `", "subject": "` + subject + `"}`
+			_, err = proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+			if i == 0 {
+				require.NoError(t, err)
+			}
+		}
+		require.ErrorContains(t, err, "message was already verified")
+		require.Equal(t, reasonReplay, rejectionReasonOf(err))
+	})
+
+	t.Run("p256", func(t *testing.T) {
+		const subject = "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3"
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		keys, err := json.Marshal(map[string]string{
+			subject: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		})
+		require.NoError(t, err)
+		keysFile := filepath.Join(t.TempDir(), "public_keys.json")
+		require.NoError(t, os.WriteFile(keysFile, keys, 0o600))
+
+		digest := sha256.Sum256([]byte(payload))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		require.NoError(t, err)
+		// (r, n-s) is also a valid P-256 signature of the payload.
+		negS := new(big.Int).Sub(elliptic.P256().Params().N, s)
+		sigs := [][]byte{
+			append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...),
+			append(r.FillBytes(make([]byte, 32)), negS.FillBytes(make([]byte, 32))...),
+		}
+
+		parsedConfig, err := configSpec.ParseYAML("algorithm: p256\npublic_keys:\n  file: "+keysFile+"\nreplay_protection: {}", nil)
+		require.NoError(t, err)
+		proc, err := ctor(parsedConfig, service.MockResources())
+		require.NoError(t, err)
+		for i, candidate := range sigs {
+			msg := `{"data": ` + payload + `, "signature": "` + hexutil.Encode(candidate) + `", "subject": "` + subject + `"}`
+			_, err = proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+			if i == 0 {
+				require.NoError(t, err)
+			}
+		}
+		require.ErrorContains(t, err, "message was already verified")
+		require.Equal(t, reasonReplay, rejectionReasonOf(err))
+	})
+}
+
+func TestSeenStore(t *testing.T) {
+	now := time.Now()
+	keys := []common.Hash{{1}, {2}, {3}}
+
+	store := newSeenStore(time.Minute, 2)
+	require.True(t, store.add(keys[0], now))
+	require.False(t, store.add(keys[0], now))
+	require.True(t, store.add(keys[1], now))
+	require.Equal(t, 2, store.len())
+
+	// Adding past max entries forgets the oldest key.
+	require.True(t, store.add(keys[2], now))
+	require.Equal(t, 2, store.len())
+	require.True(t, store.add(keys[0], now))
+	require.False(t, store.add(keys[2], now))
+
+	// Expired keys are forgotten.
+	require.True(t, store.add(keys[2], now.Add(time.Minute)))
+	require.Equal(t, 1, store.len())
+}
+
+func TestSignMessageProcessor(t *testing.T) {
+	const devKey = "0xac0974bec39a17e36ba4a6b4d238ff944bacb478cbed5efcae784d7bf4f2ff80"
+	const devAddr = "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+	// keccak256("cow"), the signer of the example in the EIP-712 specification.
+	const cowKey = "c85ef7d79691fe79573b1a7064c19c1a9819ebdbd1faaab1a8ec92344438aaf4"
+	const eip712Config = `
+eip712:
+  domain:
+    name: Ether Mail
+    version: "1"
+    chain_id: 1
+    verifying_contract: "0xCcCCccccCCCCcCCCCCCcCcCccCcCCCcCcccccccC"
+  primary_type: Mail
+  types:
+    Person:
+      - name: name
+        type: string
+      - name: wallet
+        type: address
+    Mail:
+      - name: from
+        type: Person
+      - name: to
+        type: Person
+      - name: contents
+        type: string
+`
+	keyFile := filepath.Join(t.TempDir(), "signer.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(devKey+"\n"), 0o600))
+	t.Setenv("SIGN_MESSAGE_TEST_KEY", devKey)
+	t.Setenv("SIGN_MESSAGE_TEST_COW_KEY", cowKey)
+
+	tests := []struct {
+		name              string
+		keyConfig         string
+		scheme            string
+		extraConfig       string
+		msg               string
+		expectedSubject   string
+		expectedSignature string
+	}{
+		{
+			name:            "raw with key file",
+			keyConfig:       "private_key_file: " + keyFile,
+			scheme:          "raw",
+			msg:             `{"id": "1", "data": {"timestamp":1709656316768}}`,
+			expectedSubject: devAddr,
+		},
+		{
+			name:              "eip191 with key env",
+			keyConfig:         "private_key_env: SIGN_MESSAGE_TEST_KEY",
+			scheme:            "eip191",
+			msg:               `{"data": {"timestamp":1709656316768}}`,
+			expectedSubject:   devAddr,
+			expectedSignature: "0x1c76b2a0aaedb40218055688325f8c4e66fa941b829e5c41a5f1a25dac739d70307f046b40c94d55d0ef4452fdf4ca1a70196b53b280a348a7d042662a80b0511c",
+		},
+		{
+			name:            "data with whitespace and html characters",
+			keyConfig:       "private_key_env: SIGN_MESSAGE_TEST_KEY",
+			scheme:          "raw",
+			msg:             `{"data": { "note": "<a & b>",  "values": [1, 2] }, "subject": "0x0000000000000000000000000000000000000000"}`,
+			expectedSubject: devAddr,
+		},
+		{
+			name:              "envelope",
+			keyConfig:         "private_key_env: SIGN_MESSAGE_TEST_KEY",
+			scheme:            "raw",
+			extraConfig:       "envelope: {}",
+			msg:               envelopeEvent,
+			expectedSubject:   devAddr,
+			expectedSignature: "0x07cfdeda8734e29bc5a6cd262b625dc6af508dd81b59b13071ee61df4208030a603303c80c3030a861536883ebc8b2237dbc1244831530067bc4d488e8173fb81c",
+		},
+		{
+			name:              "jcs",
+			keyConfig:         "private_key_env: SIGN_MESSAGE_TEST_KEY",
+			scheme:            "raw",
+			extraConfig:       "canonicalization: jcs",
+			msg:               `{"data": {"vin": "ABC", "timestamp": 1709656316768, "speed": 12.50}}`,
+			expectedSubject:   devAddr,
+			expectedSignature: "0x3264b3afaa44307497ac826867d44ef6d2ab97f3467751197c76e84fb8568dea118e27bd01188df4f301169fd05b9d05705cfb103f109e3545f75f590c95bd971b",
+		},
+		{
+			name:        "eip712",
+			keyConfig:   "private_key_env: SIGN_MESSAGE_TEST_COW_KEY",
+			scheme:      "eip712",
+			extraConfig: eip712Config,
+			msg: `{"data": {
+				"from": {"name": "Cow", "wallet": "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826"},
+				"to": {"name": "Bob", "wallet": "0xbBbBBBBbbBBBbbbBbbBbbbbBBbBbbbbBbBbbBBbB"},
+				"contents": "Hello, Bob!"
+			}}`,
+			expectedSubject:   "0xCD2a3d9F938E13CD947Ec05AbC7FE734Df8DD826",
+			expectedSignature: "0x4355c47d63924e8a72e509b65029052eb6c299d53a04e167c5775fd466751c9d07299936d304c153f6443dfa05f40ff007d72911b6f72307f996231605b915621c",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := signConfigSpec.ParseYAML(tt.keyConfig+"\nhash_scheme: "+tt.scheme+"\n"+tt.extraConfig, nil)
+			require.NoError(t, err)
+			signer, err := signCtor(parsedConfig)
+			require.NoError(t, err)
+
+			signed, err := signer.Process(context.Background(), service.NewMessage([]byte(tt.msg)))
+			require.NoError(t, err)
+			require.Len(t, signed, 1)
+			payload, err := signed[0].AsBytes()
+			require.NoError(t, err)
+
+			var event map[string]any
+			require.NoError(t, json.Unmarshal(payload, &event))
+			require.Equal(t, tt.expectedSubject, event["subject"])
+			if tt.expectedSignature != "" {
+				require.Equal(t, tt.expectedSignature, event["signature"])
+			}
+
+			// The signed message must be accepted by check_signature with the same hash scheme.
+			parsedConfig, err = configSpec.ParseYAML("hash_scheme: ["+tt.scheme+"]\n"+tt.extraConfig, nil)
+			require.NoError(t, err)
+			verifier, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+			_, err = verifier.Process(context.Background(), service.NewMessage(payload))
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestSignMessageProcessorConfig(t *testing.T) {
+	t.Setenv("SIGN_MESSAGE_TEST_KEY", "not a key")
+
+	tests := []struct {
+		name        string
+		config      string
+		expectedErr string
+	}{
+		{
+			name:        "no key",
+			config:      "hash_scheme: raw",
+			expectedErr: "one of private_key_file or private_key_env must be set",
+		},
+		{
+			name:        "both keys",
+			config:      "private_key_file: ./signer.key\nprivate_key_env: SIGN_MESSAGE_TEST_KEY",
+			expectedErr: "only one of private_key_file and private_key_env may be set",
+		},
+		{
+			name:        "unset env",
+			config:      "private_key_env: SIGN_MESSAGE_TEST_UNSET",
+			expectedErr: "environment variable SIGN_MESSAGE_TEST_UNSET is not set",
+		},
+		{
+			name:        "invalid key",
+			config:      "private_key_env: SIGN_MESSAGE_TEST_KEY",
+			expectedErr: "failed to parse private key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := signConfigSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			_, err = signCtor(parsedConfig)
+			require.ErrorContains(t, err, tt.expectedErr)
+		})
+	}
+}
+
+func TestSignatureProcessorAlgorithms(t *testing.T) {
+	const payload = `{"timestamp":1709656316768}`
+	const edSubject = "0x06fF8E7A4A159EA388da7c133DC5F79727868d83"
+	const p256Subject = "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3"
+
+	edKey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	pemKey := func(pub any) string {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		require.NoError(t, err)
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	keys, err := json.Marshal(map[string]string{
+		edSubject:   pemKey(edKey.Public()),
+		p256Subject: pemKey(&p256Key.PublicKey),
+	})
+	require.NoError(t, err)
+	keysFile := filepath.Join(t.TempDir(), "public_keys.json")
+	require.NoError(t, os.WriteFile(keysFile, keys, 0o600))
+
+	digest := sha256.Sum256([]byte(payload))
+	p256DER, err := ecdsa.SignASN1(rand.Reader, p256Key, digest[:])
+	require.NoError(t, err)
+	r, s, err := ecdsa.Sign(rand.Reader, p256Key, digest[:])
+	require.NoError(t, err)
+	p256Raw := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	edSig := ed25519.Sign(edKey, []byte(payload))
+
+	tests := []struct {
+		name           string
+		algorithm      string
+		subject        string
+		signature      []byte
+		expectedErr    string
+		expectedReason rejectionReason
+	}{
+		{
+			name:      "ed25519",
+			algorithm: algorithmEd25519,
+			subject:   edSubject,
+			signature: edSig,
+		},
+		{
+			name:           "ed25519 signature by another key",
+			algorithm:      algorithmEd25519,
+			subject:        edSubject,
+			signature:      ed25519.Sign(ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)), []byte(payload)),
+			expectedErr:    "invalid ed25519 signature",
+			expectedReason: reasonInvalidSignature,
+		},
+		{
+			name:      "p256 der signature",
+			algorithm: algorithmP256,
+			subject:   p256Subject,
+			signature: p256DER,
+		},
+		{
+			name:      "p256 raw signature",
+			algorithm: algorithmP256,
+			subject:   p256Subject,
+			signature: p256Raw,
+		},
+		{
+			name:           "p256 signature of other data",
+			algorithm:      algorithmP256,
+			subject:        p256Subject,
+			signature:      edSig,
+			expectedErr:    "invalid p256 signature",
+			expectedReason: reasonInvalidSignature,
+		},
+		{
+			name:           "key of another algorithm",
+			algorithm:      algorithmP256,
+			subject:        edSubject,
+			signature:      p256DER,
+			expectedErr:    "is not a P-256 key",
+			expectedReason: reasonUnknownSigner,
+		},
+		{
+			name:           "unknown subject",
+			algorithm:      algorithmEd25519,
+			subject:        "0x000000000000000000000000000000000000dEaD",
+			signature:      edSig,
+			expectedErr:    "no public key for subject",
+			expectedReason: reasonUnknownSigner,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML("algorithm: "+tt.algorithm+"\npublic_keys:\n  file: "+keysFile, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+
+			msg := `{"data": ` + payload + `, "signature": "` + hexutil.Encode(tt.signature) + `", "subject": "` + tt.subject + `"}`
+			_, err = proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+			if tt.expectedErr != "" {
+				require.ErrorContains(t, err, tt.expectedErr)
+				require.Equal(t, tt.expectedReason, rejectionReasonOf(err))
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("missing public keys", func(t *testing.T) {
+		parsedConfig, err := configSpec.ParseYAML("algorithm: ed25519", nil)
+		require.NoError(t, err)
+		_, err = ctor(parsedConfig, service.MockResources())
+		require.ErrorContains(t, err, "the public_keys field must be set")
+	})
+
+	t.Run("authorized signers", func(t *testing.T) {
+		signersFile := filepath.Join(t.TempDir(), "signers.json")
+		require.NoError(t, os.WriteFile(signersFile, []byte(`{"`+edSubject+`": ["`+p256Subject+`"]}`), 0o600))
+		parsedConfig, err := configSpec.ParseYAML("algorithm: ed25519\npublic_keys:\n  file: "+keysFile+
+			"\nauthorized_signers:\n  file: "+signersFile, nil)
+		require.NoError(t, err)
+		_, err = ctor(parsedConfig, service.MockResources())
+		require.ErrorContains(t, err, "the authorized_signers file and url are only supported with the secp256k1 algorithm")
+	})
+
+	t.Run("denied signer", func(t *testing.T) {
+		parsedConfig, err := configSpec.ParseYAML("algorithm: ed25519\npublic_keys:\n  file: "+keysFile+
+			"\nauthorized_signers:\n  deny: [\""+edSubject+"\"]", nil)
+		require.NoError(t, err)
+		proc, err := ctor(parsedConfig, service.MockResources())
+		require.NoError(t, err)
+		msg := `{"data": ` + payload + `, "signature": "` + hexutil.Encode(edSig) + `", "subject": "` + edSubject + `"}`
+		_, err = proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+		require.ErrorContains(t, err, "is denied")
+	})
+}
+
+// envelopeEvent is a CloudEvent whose canonical envelope is signed by the development key of
+// 0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266 with the raw hash scheme.
+const envelopeEvent = `{
+	"specversion": "1.0",
+	"id": "2fHbFXPWzrVActDb7WqWCfqeiYe",
+	"source": "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266",
+	"subject": "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266",
+	"time": "2024-03-05T16:31:56.768Z",
+	"type": "dimo.status",
+	"dataschema": "dimo/v1",
+	"data": {"timestamp": 1709656316768},
+	"signature": "0x07cfdeda8734e29bc5a6cd262b625dc6af508dd81b59b13071ee61df4208030a603303c80c3030a861536883ebc8b2237dbc1244831530067bc4d488e8173fb81c"
+}`
+
+func TestEnvelopeCanonicalization(t *testing.T) {
+	// Golden vectors for the canonical envelope, changing them breaks every signature produced in envelope mode.
+	tests := []struct {
+		name         string
+		config       string
+		event        string
+		expected     string
+		expectedHash string
+	}{
+		{
+			name:         "default attributes",
+			config:       "{}",
+			event:        envelopeEvent,
+			expected:     `{"data":{"timestamp":1709656316768},"dataschema":"dimo/v1","id":"2fHbFXPWzrVActDb7WqWCfqeiYe","source":"0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266","subject":"0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266","time":"2024-03-05T16:31:56.768Z","type":"dimo.status"}`,
+			expectedHash: "0x97a1dbc926a252102262de37588cc1456e9b8c25b49a0b994d578062f1eec347",
+		},
+		{
+			name:     "missing attributes are omitted and values are only compacted",
+			config:   "{}",
+			event:    `{ "type" : "dimo.status", "data" : { "b" : 1, "a" : "é <x>" } }`,
+			expected: `{"data":{"b":1,"a":"é <x>"},"type":"dimo.status"}`,
+		},
+		{
+			name:     "configured attributes",
+			config:   "attributes: [time, id]",
+			event:    `{"id":"1","time":"2024-03-05T16:31:56Z","type":"ignored","data":null}`,
+			expected: `{"data":null,"id":"1","time":"2024-03-05T16:31:56Z"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML("envelope: "+tt.config, nil)
+			require.NoError(t, err)
+			canonicalizer, err := newEnvelopeCanonicalizer(parsedConfig.Namespace(envelopeField))
+			require.NoError(t, err)
+
+			canonical, err := canonicalizer.canonicalize([]byte(tt.event))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, string(canonical))
+			if tt.expectedHash != "" {
+				hash, err := hashSchemeRaw.hash(canonical, nil)
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedHash, hash.Hex())
+			}
+		})
+	}
+}
+
+func TestSignatureProcessorEnvelope(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		event       string
+		expectedErr string
+	}{
+		{
+			name:   "signed envelope",
+			config: "envelope: {}",
+			event:  envelopeEvent,
+		},
+		{
+			name:        "rewritten time",
+			config:      "envelope: {}",
+			event:       strings.Replace(envelopeEvent, "2024-03-05T16:31:56.768Z", "2024-03-06T16:31:56.768Z", 1),
+			expectedErr: "recovered wrong address",
+		},
+		{
+			name:        "repeated time",
+			config:      "envelope: {}",
+			event:       strings.Replace(envelopeEvent, `"specversion": "1.0",`, `"specversion": "1.0", "time": "2024-03-06T16:31:56.768Z",`, 1),
+			expectedErr: "duplicate attribute 'time'",
+		},
+		{
+			name:        "repeated subject with a different case",
+			config:      "envelope: {}",
+			event:       strings.Replace(envelopeEvent, `"specversion": "1.0",`, `"specversion": "1.0", "SUBJECT": "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61",`, 1),
+			expectedErr: "duplicate attribute 'subject'",
+		},
+		{
+			name:   "unsigned attribute changed",
+			config: "envelope: {}",
+			event:  strings.Replace(envelopeEvent, `"specversion": "1.0"`, `"specversion": "1.1"`, 1),
+		},
+		{
+			name:        "data only",
+			config:      "{}",
+			event:       envelopeEvent,
+			expectedErr: "recovered wrong address",
+		},
+		{
+			name:        "payload and envelope",
+			config:      "envelope: {}\npayload: ${!content()}",
+			event:       envelopeEvent,
+			expectedErr: "the payload and envelope fields can not both be set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			if err != nil {
+				require.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+
+			_, err = proc.Process(context.Background(), service.NewMessage([]byte(tt.event)))
+			if tt.expectedErr != "" {
+				require.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestCanonicalizeJSON(t *testing.T) {
+	// Vectors from RFC 8785 sections 3.2.2 and 3.2.3.
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "values",
+			input:    `{"numbers": [333333333.33333329, 1E30, 4.50, 2e-3, 0.000000000000000000000000001], "string": "\u20ac$\u000F\u000aA'\u0042\u0022\u005c\\\"\/", "literals": [null, true, false]}`,
+			expected: `{"literals":[null,true,false],"numbers":[333333333.3333333,1e+30,4.5,0.002,1e-27],"string":"€$\u000f\nA'B\"\\\\\"/"}`,
+		},
+		{
+			name:     "property order",
+			input:    `{"\u20ac": 1, "\r": 2, "\ufb33": 3, "1": 4, "\ud83d\ude00": 5, "\u0080": 6, "\u00f6": 7}`,
+			expected: "{\"\\r\":2,\"1\":4,\"\u0080\":6,\"ö\":7,\"€\":1,\"😀\":5,\"\ufb33\":3}",
+		},
+		{
+			name:     "numbers",
+			input:    `[-0, 1e21, 1e-7, 100, 1.0e2, 0.1]`,
+			expected: `[0,1e+21,1e-7,100,100,0.1]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canonical, err := canonicalizeJSON([]byte(tt.input))
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, string(canonical))
+		})
+	}
+
+	_, err := canonicalizeJSON([]byte(`{"a": 1} {"b": 2}`))
+	require.Error(t, err)
+	_, err = canonicalizeJSON([]byte(`{"a": 1, "a": 2}`))
+	require.ErrorContains(t, err, "duplicate member name 'a'")
+	_, err = canonicalizeJSON([]byte(`{"a": [{"b": 1}, {"b": 1, "c": {"d": 1, "d": 1}}]}`))
+	require.ErrorContains(t, err, "duplicate member name 'd'")
+}
+
+func TestSignatureProcessorJCS(t *testing.T) {
+	// Signed by the development key of 0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266 over
+	// the canonical form {"speed":12.5,"timestamp":1709656316768,"vin":"ABC"} with the raw hash scheme.
+	const signature = "0x3264b3afaa44307497ac826867d44ef6d2ab97f3467751197c76e84fb8568dea118e27bd01188df4f301169fd05b9d05705cfb103f109e3545f75f590c95bd971b"
+	const subject = "0xf39Fd6e51aad88F6F4ce6aB8827279cffFb92266"
+
+	equivalent := []string{
+		`{"speed":12.5,"timestamp":1709656316768,"vin":"ABC"}`,
+		`{"vin":"ABC","timestamp":1709656316768,"speed":12.5}`,
+		`{ "timestamp" : 1709656316768, "speed" : 12.50, "vin" : "\u0041BC" }`,
+		`{"speed":1.25e1,"timestamp":1.709656316768e12,"vin":"ABC"}`,
+	}
+
+	for _, canonicalization := range []string{canonicalizationNone, canonicalizationJCS} {
+		parsedConfig, err := configSpec.ParseYAML("canonicalization: "+canonicalization, nil)
+		require.NoError(t, err)
+		proc, err := ctor(parsedConfig, service.MockResources())
+		require.NoError(t, err)
+
+		for i, data := range equivalent {
+			t.Run(fmt.Sprintf("%s %d", canonicalization, i), func(t *testing.T) {
+				msg := `{"data": ` + data + `, "signature": "` + signature + `", "subject": "` + subject + `"}`
+				_, err := proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+				// Without canonicalization only the exact signed bytes verify.
+				if canonicalization == canonicalizationNone && i > 0 {
+					require.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+			})
+		}
+	}
+
+	// Values that differ after canonicalization are still rejected.
+	parsedConfig, err := configSpec.ParseYAML("canonicalization: jcs", nil)
+	require.NoError(t, err)
+	proc, err := ctor(parsedConfig, service.MockResources())
+	require.NoError(t, err)
+	msg := `{"data": {"speed":12.6,"timestamp":1709656316768,"vin":"ABC"}, "signature": "` + signature + `", "subject": "` + subject + `"}`
+	_, err = proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+	require.ErrorContains(t, err, "recovered wrong address")
+
+	// A duplicate member in front of a signed one would be read by consumers that keep the first duplicate.
+	msg = `{"data": {"speed":999,"speed":12.5,"timestamp":1709656316768,"vin":"ABC"}, "signature": "` + signature + `", "subject": "` + subject + `"}`
+	_, err = proc.Process(context.Background(), service.NewMessage([]byte(msg)))
+	require.ErrorContains(t, err, "duplicate member name 'speed'")
+	require.Equal(t, reasonMalformedJSON, rejectionReasonOf(err))
+}
+
+func TestSignatureProcessorRejectionReasons(t *testing.T) {
+	const signature = "0xed107d9e947ce3208f2a349fe9de841295252ed3157a6a6c3725c5b2fd47ccaf1407ba498f09a872ce409d3434162512f7d0b08fbc0561f407015b39953bb6d61c"
+	const signer = "0x318F53cC0775fdfcb95A378Fd3228Dc564A28c61"
+	event := func(signature, subject string) string {
+		return `{"data": {"timestamp":1709656316768}, "signature": "` + signature + `", "subject": "` + subject + `"}`
+	}
+	signersServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer signersServer.Close()
+
+	tests := []struct {
+		name           string
+		config         string
+		msgs           []string
+		expectedReason rejectionReason
+	}{
+		{
+			name:           "malformed json",
+			config:         "{}",
+			msgs:           []string{`{"data": {"timestamp":`},
+			expectedReason: reasonMalformedJSON,
+		},
+		{
+			name:           "invalid signer",
+			config:         `signer: "not an address"`,
+			msgs:           []string{event(signature, signer)},
+			expectedReason: reasonMalformedMessage,
+		},
+		{
+			name:           "short signature",
+			config:         "{}",
+			msgs:           []string{event("0xed107d9e", signer)},
+			expectedReason: reasonSignatureLength,
+		},
+		{
+			name:           "bad recovery id",
+			config:         "{}",
+			msgs:           []string{event(signature[:len(signature)-2]+"1f", signer)},
+			expectedReason: reasonRecoveryID,
+		},
+		{
+			name:           "address mismatch",
+			config:         "{}",
+			msgs:           []string{event(signature, "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3")},
+			expectedReason: reasonAddressMismatch,
+		},
+		{
+			name:           "denied signer",
+			config:         "authorized_signers:\n  deny: [\"" + signer + "\"]",
+			msgs:           []string{event(signature, signer)},
+			expectedReason: reasonDeniedSigner,
+		},
+		{
+			name:           "signer lookup failed",
+			config:         "authorized_signers:\n  url: " + signersServer.URL + "/subjects/{subject}/signers",
+			msgs:           []string{event(signature, "0xDC1eE274BCA98b421293f3737D1b9E4563c60cb3")},
+			expectedReason: reasonSignerLookupFailed,
+		},
+		{
+			name:           "replay",
+			config:         "replay_protection: {}",
+			msgs:           []string{event(signature, signer), event(signature, signer)},
+			expectedReason: reasonReplay,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec.ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+
+			var msg *service.Message
+			for _, raw := range tt.msgs {
+				msg = service.NewMessage([]byte(raw))
+				_, err = proc.Process(context.Background(), msg)
+			}
+			require.Error(t, err)
+			require.Equal(t, tt.expectedReason, rejectionReasonOf(err))
+			reason, ok := msg.MetaGet(metaRejectionReason)
+			require.True(t, ok)
+			require.Equal(t, string(tt.expectedReason), reason)
+
+			// Batches mark the rejected message with the same reason.
+			batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte(tt.msgs[len(tt.msgs)-1]))})
+			require.NoError(t, err)
+			require.Error(t, batches[0][0].GetError())
+			reason, ok = batches[0][0].MetaGet(metaRejectionReason)
+			require.True(t, ok)
+			require.Equal(t, string(tt.expectedReason), reason)
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package checksignature
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/signer/core/apitypes"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+// eip712DomainType is the name of the type that describes the EIP-712 domain separator.
+const eip712DomainType = "EIP712Domain"
+
+const (
+	eip712Field            = "eip712"
+	eip712DomainField      = "domain"
+	eip712PrimaryTypeField = "primary_type"
+	eip712TypesField       = "types"
+)
+
+// eip712ConfigField describes the typed data that the CloudEvent data is expected to be signed as.
+var eip712ConfigField = service.NewObjectField(eip712Field,
+	service.NewObjectField(eip712DomainField,
+		service.NewStringField("name").Description("Name of the signing domain.").Default(""),
+		service.NewStringField("version").Description("Version of the signing domain.").Default(""),
+		service.NewIntField("chain_id").Description("Chain ID of the signing domain.").Optional(),
+		service.NewStringField("verifying_contract").Description("Address of the contract that verifies the signature.").Default(""),
+	).Description("The EIP-712 domain. Only the values that are set are included in the domain separator, at least one must be set."),
+	service.NewStringField(eip712PrimaryTypeField).Description("The type of the top level object in the data."),
+	service.NewAnyField(eip712TypesField).
+		Description("Type definitions keyed by type name, each a list of `name` and `type` pairs. "+
+			"The `EIP712Domain` type is derived from the domain when it is not provided.").
+		Example(map[string]any{
+			"Status": []any{
+				map[string]any{"name": "timestamp", "type": "uint64"},
+			},
+		}),
+).Description("Typed data definition used by the `eip712` hash scheme.").Optional()
+
+// typedDataHasher computes EIP-712 hashes of JSON payloads for a fixed domain and set of types.
+type typedDataHasher struct {
+	typedData       apitypes.TypedData
+	domainSeparator []byte
+}
+
+// newTypedDataHasher creates a typedDataHasher from the eip712 namespace of the processor config.
+func newTypedDataHasher(conf *service.ParsedConfig) (*typedDataHasher, error) {
+	primaryType, err := conf.FieldString(eip712PrimaryTypeField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse primary type: %w", err)
+	}
+	rawTypes, err := conf.FieldAny(eip712TypesField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse types: %w", err)
+	}
+	typesJSON, err := json.Marshal(rawTypes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode types: %w", err)
+	}
+	var types apitypes.Types
+	if err := json.Unmarshal(typesJSON, &types); err != nil {
+		return nil, fmt.Errorf("types must be a map of type names to lists of name and type pairs: %w", err)
+	}
+	if _, ok := types[primaryType]; !ok {
+		return nil, fmt.Errorf("primary type '%s' is not defined in types", primaryType)
+	}
+
+	domain, domainFields, err := parseDomain(conf.Namespace(eip712DomainField))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse domain: %w", err)
+	}
+	if _, ok := types[eip712DomainType]; !ok {
+		types[eip712DomainType] = domainFields
+	}
+	typedData := apitypes.TypedData{
+		Types:       types,
+		PrimaryType: primaryType,
+		Domain:      domain,
+	}
+	// Hashing the domain also validates the types.
+	domainSeparator, err := typedData.HashStruct(eip712DomainType, domain.Map())
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash domain: %w", err)
+	}
+
+	return &typedDataHasher{
+		typedData:       typedData,
+		domainSeparator: domainSeparator,
+	}, nil
+}
+
+// hash returns the EIP-712 digest of the JSON object in data.
+func (t *typedDataHasher) hash(data []byte) (common.Hash, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// Keep numbers as json.Number so that large integers do not lose precision.
+	decoder.UseNumber()
+	var message map[string]any
+	if err := decoder.Decode(&message); err != nil {
+		return common.Hash{}, fmt.Errorf("data is not a JSON object: %w", err)
+	}
+	if message == nil {
+		return common.Hash{}, fmt.Errorf("data is not a JSON object")
+	}
+	if _, err := convertNumbers(message); err != nil {
+		return common.Hash{}, err
+	}
+
+	structHash, err := t.typedData.HashStruct(t.typedData.PrimaryType, message)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return crypto.Keccak256Hash([]byte{0x19, 0x01}, t.domainSeparator, structHash), nil
+}
+
+// convertNumbers replaces the integers in value with big.Ints, which apitypes encodes without losing precision.
+// Other numbers are left as json.Number so that they do not match any EIP-712 type.
+func convertNumbers(value any) (any, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, fmt.Errorf("typed data cannot contain null")
+	case json.Number:
+		if n, ok := new(big.Int).SetString(v.String(), 10); ok {
+			return n, nil
+		}
+	case map[string]any:
+		for key, item := range v {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			v[key] = converted
+		}
+	case []any:
+		for i, item := range v {
+			converted, err := convertNumbers(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+	}
+	return value, nil
+}
+
+// parseDomain returns the configured domain along with the matching EIP712Domain type definition.
+// The fields are ordered as defined by EIP-712.
+func parseDomain(conf *service.ParsedConfig) (apitypes.TypedDataDomain, []apitypes.Type, error) {
+	var domain apitypes.TypedDataDomain
+	var fields []apitypes.Type
+
+	name, err := conf.FieldString("name")
+	if err != nil {
+		return domain, nil, err
+	}
+	if name != "" {
+		domain.Name = name
+		fields = append(fields, apitypes.Type{Name: "name", Type: "string"})
+	}
+	version, err := conf.FieldString("version")
+	if err != nil {
+		return domain, nil, err
+	}
+	if version != "" {
+		domain.Version = version
+		fields = append(fields, apitypes.Type{Name: "version", Type: "string"})
+	}
+	if conf.Contains("chain_id") {
+		chainID, err := conf.FieldInt("chain_id")
+		if err != nil {
+			return domain, nil, err
+		}
+		domain.ChainId = (*math.HexOrDecimal256)(big.NewInt(int64(chainID)))
+		fields = append(fields, apitypes.Type{Name: "chainId", Type: "uint256"})
+	}
+	verifyingContract, err := conf.FieldString("verifying_contract")
+	if err != nil {
+		return domain, nil, err
+	}
+	if verifyingContract != "" {
+		if !common.IsHexAddress(verifyingContract) {
+			return domain, nil, fmt.Errorf("verifying contract is not a valid hexadecimal address: %s", verifyingContract)
+		}
+		domain.VerifyingContract = verifyingContract
+		fields = append(fields, apitypes.Type{Name: "verifyingContract", Type: "address"})
+	}
+	if len(fields) == 0 {
+		return domain, nil, fmt.Errorf("at least one domain value must be set")
+	}
+	return domain, fields, nil
+}
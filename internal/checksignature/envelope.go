@@ -0,0 +1,123 @@
+package checksignature
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	envelopeField           = "envelope"
+	envelopeAttributesField = "attributes"
+)
+
+var envelopeConfigField = service.NewObjectField(envelopeField,
+	service.NewStringListField(envelopeAttributesField).
+		Description("CloudEvent attributes that are signed along with the data.").
+		Default([]string{"id", "source", "subject", "time", "type", "dataschema"}),
+).Description("If set, the signature covers the canonical CloudEvent envelope instead of only the data. " +
+	"The envelope is a JSON object of the configured attributes that are present in the event and the `data` field, " +
+	"with keys sorted bytewise, no insignificant whitespace and values otherwise kept exactly as they appear in the event, " +
+	"for example `{\"data\":{\"speed\":12},\"id\":\"1\",\"time\":\"2024-03-05T16:31:56Z\"}`.").Optional()
+
+// envelopeCanonicalizer produces the deterministic JSON encoding of a CloudEvent that is signed in envelope mode.
+type envelopeCanonicalizer struct {
+	attributes []string
+}
+
+// newEnvelopeCanonicalizer creates an envelopeCanonicalizer from the envelope namespace of a processor config.
+func newEnvelopeCanonicalizer(conf *service.ParsedConfig) (*envelopeCanonicalizer, error) {
+	attributes, err := conf.FieldStringList(envelopeAttributesField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse attributes: %w", err)
+	}
+	for _, attr := range attributes {
+		switch attr {
+		case "":
+			return nil, fmt.Errorf("attribute names must not be empty")
+		case "data", signatureField:
+			return nil, fmt.Errorf("attribute '%s' can not be listed", attr)
+		}
+	}
+	return &envelopeCanonicalizer{attributes: append(attributes, "data")}, nil
+}
+
+// canonicalize returns the canonical envelope of the raw CloudEvent JSON in payload.
+func (e *envelopeCanonicalizer) canonicalize(payload []byte) ([]byte, error) {
+	event, err := decodeEvent(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse message as a CloudEvent: %w", err)
+	}
+	return e.canonicalizeEvent(event)
+}
+
+// decodeEvent decodes the attributes of the CloudEvent JSON in payload into their raw values.
+// Attributes that are repeated, also with a different case, are rejected. Decoders disagree on
+// which one wins, so a repeated attribute could be read differently from the one that was signed.
+func decodeEvent(payload []byte) (map[string]json.RawMessage, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if tok, err := decoder.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("message is not a JSON object")
+	}
+	event := map[string]json.RawMessage{}
+	for decoder.More() {
+		tok, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		key := tok.(string)
+		for other := range event {
+			if strings.EqualFold(other, key) {
+				return nil, fmt.Errorf("duplicate attribute '%s'", key)
+			}
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		event[key] = value
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unexpected data after JSON object")
+	}
+	return event, nil
+}
+
+// canonicalizeEvent returns the canonical envelope of a CloudEvent decoded into its raw fields.
+func (e *envelopeCanonicalizer) canonicalizeEvent(event map[string]json.RawMessage) ([]byte, error) {
+	keys := make([]string, 0, len(e.attributes))
+	for _, attr := range e.attributes {
+		if _, ok := event[attr]; ok && !slices.Contains(keys, attr) {
+			keys = append(keys, attr)
+		}
+	}
+	slices.Sort(keys)
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encodedKey, err := json.Marshal(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode attribute name: %w", err)
+		}
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		if err := json.Compact(&buf, event[key]); err != nil {
+			return nil, fmt.Errorf("failed to compact attribute '%s': %w", key, err)
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
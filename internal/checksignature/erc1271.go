@@ -0,0 +1,207 @@
+package checksignature
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	erc1271Field        = "erc1271"
+	erc1271RPCURLField  = "rpc_url"
+	erc1271TimeoutField = "timeout"
+	erc1271CacheField   = "cache_ttl"
+)
+
+// erc1271MagicValue is the selector of isValidSignature(bytes32,bytes), which the
+// function returns when the signature is valid for the account.
+var erc1271MagicValue = []byte{0x16, 0x26, 0xba, 0x7e}
+
+var erc1271ConfigField = service.NewObjectField(erc1271Field,
+	service.NewStringField(erc1271RPCURLField).Description("Ethereum JSON-RPC endpoint used to call the subject contract."),
+	service.NewDurationField(erc1271TimeoutField).Description("Maximum time to wait for an isValidSignature call.").Default("5s"),
+	service.NewDurationField(erc1271CacheField).
+		Description("How long the result of an isValidSignature call is cached per account, hash and signature. "+
+			"Accounts without code are not called again for the same time. Zero disables the cache.").
+		Default("10m"),
+).Description("If set, a signature that does not recover to the subject is checked with ERC-1271 `isValidSignature`, " +
+	"so that smart contract accounts such as Safe and ERC-4337 wallets can sign messages.").Optional()
+
+// ContractCaller executes a read-only call against a contract and returns the call's return data.
+// A nil blockNumber calls the latest block. It has the method set of ethereum.ContractCaller,
+// so an ethclient.Client or the client of a go-ethereum simulated backend can be used.
+type ContractCaller interface {
+	CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error)
+}
+
+// erc1271Verifier checks signatures of smart contract accounts with ERC-1271.
+type erc1271Verifier struct {
+	caller  ContractCaller
+	timeout time.Duration
+	// results caches isValidSignature outcomes and noCode the accounts without code. Both are nil when caching is disabled.
+	results *gocache.Cache
+	noCode  *gocache.Cache
+}
+
+// newERC1271Verifier creates an erc1271Verifier from the erc1271 namespace of the processor config.
+func newERC1271Verifier(conf *service.ParsedConfig) (*erc1271Verifier, error) {
+	rpcURL, err := conf.FieldString(erc1271RPCURLField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rpc url: %w", err)
+	}
+	timeout, err := conf.FieldDuration(erc1271TimeoutField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timeout: %w", err)
+	}
+	cacheTTL, err := conf.FieldDuration(erc1271CacheField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cache ttl: %w", err)
+	}
+	verifier := &erc1271Verifier{
+		caller:  &rpcContractCaller{url: rpcURL, client: http.DefaultClient},
+		timeout: timeout,
+	}
+	if cacheTTL > 0 {
+		verifier.results = gocache.New(cacheTTL, 2*cacheTTL)
+		verifier.noCode = gocache.New(cacheTTL, 2*cacheTTL)
+	}
+	return verifier, nil
+}
+
+// isValidSignature reports whether account accepts sig as its signature of hash.
+// Accounts without code return no data and are reported as invalid.
+// Results are cached so that repeated or junk messages do not call the account every time.
+func (e *erc1271Verifier) isValidSignature(ctx context.Context, account common.Address, hash common.Hash, sig []byte) (bool, error) {
+	resultKey := crypto.Keccak256Hash(account.Bytes(), hash.Bytes(), sig).Hex()
+	if e.results != nil {
+		if _, found := e.noCode.Get(account.Hex()); found {
+			return false, nil
+		}
+		if valid, found := e.results.Get(resultKey); found {
+			return valid.(bool), nil
+		}
+	}
+
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	ret, err := e.caller.CallContract(ctx, ethereum.CallMsg{To: &account, Data: packIsValidSignature(hash, sig)}, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to call isValidSignature on %s: %w", account, err)
+	}
+	if len(ret) == 0 {
+		if e.noCode != nil {
+			e.noCode.SetDefault(account.Hex(), struct{}{})
+		}
+		return false, nil
+	}
+	valid := len(ret) >= len(erc1271MagicValue) && bytes.Equal(ret[:len(erc1271MagicValue)], erc1271MagicValue)
+	if e.results != nil {
+		e.results.SetDefault(resultKey, valid)
+	}
+	return valid, nil
+}
+
+// packIsValidSignature ABI encodes a call to isValidSignature(bytes32,bytes).
+func packIsValidSignature(hash common.Hash, sig []byte) []byte {
+	paddedLen := (len(sig) + common.HashLength - 1) / common.HashLength * common.HashLength
+	data := make([]byte, 0, len(erc1271MagicValue)+3*common.HashLength+paddedLen)
+	data = append(data, erc1271MagicValue...)
+	data = append(data, hash.Bytes()...)
+	// Offset of the dynamic bytes argument, which follows the two head words.
+	data = append(data, common.LeftPadBytes(big.NewInt(2*common.HashLength).Bytes(), common.HashLength)...)
+	data = append(data, common.LeftPadBytes(big.NewInt(int64(len(sig))).Bytes(), common.HashLength)...)
+	data = append(data, common.RightPadBytes(sig, paddedLen)...)
+	return data
+}
+
+// rpcContractCaller calls contracts with eth_call on an Ethereum JSON-RPC endpoint.
+type rpcContractCaller struct {
+	url    string
+	client *http.Client
+}
+
+type rpcRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	ID      int    `json:"id"`
+	Method  string `json:"method"`
+	Params  []any  `json:"params"`
+}
+
+type rpcCallArgs struct {
+	From *common.Address `json:"from,omitempty"`
+	To   *common.Address `json:"to"`
+	Data hexutil.Bytes   `json:"data"`
+}
+
+type rpcResponse struct {
+	Result hexutil.Bytes `json:"result"`
+	Error  *rpcError     `json:"error"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// CallContract executes eth_call against blockNumber, or the latest block if it is nil.
+// Only the sender, recipient and data of call are sent.
+func (r *rpcContractCaller) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	block := "latest"
+	if blockNumber != nil {
+		block = hexutil.EncodeBig(blockNumber)
+	}
+	args := rpcCallArgs{To: call.To, Data: call.Data}
+	if call.From != zeroAddr {
+		args.From = &call.From
+	}
+	body, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		ID:      1,
+		Method:  "eth_call",
+		Params:  []any{args, block},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if rpcResp.Error != nil {
+		return nil, rpcResp.Error
+	}
+	return rpcResp.Result, nil
+}
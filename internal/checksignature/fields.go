@@ -0,0 +1,151 @@
+package checksignature
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	signerField    = "signer"
+	signatureField = "signature"
+	payloadField   = "payload"
+)
+
+var signerConfigField = service.NewInterpolatedStringField(signerField).
+	Description("Address that is expected to have signed the payload. Defaults to the CloudEvent `subject`.").
+	Examples(`${!json("source")}`, `${!@signer}`).
+	Optional()
+
+var signatureConfigField = service.NewInterpolatedStringField(signatureField).
+	Description("Hex encoded signature of the payload. Defaults to the `signature` field of the CloudEvent.").
+	Examples(`${!@kafka_signature}`).
+	Optional()
+
+var payloadConfigField = service.NewInterpolatedStringField(payloadField).
+	Description("The signed bytes. Defaults to the raw `data` field of the CloudEvent. "+
+		"Note that JSON values produced by an interpolation are re-serialized and may no longer match the signed bytes.").
+	Examples(`${!content()}`, `${!@signed_payload}`).
+	Optional()
+
+// signedMessage holds the parts of a message needed to verify its signature.
+type signedMessage struct {
+	signer    common.Address
+	signature []byte
+	payload   []byte
+}
+
+// messageFields extracts the signer, signature and payload from a message.
+// Fields that are not configured are read from the message as a CloudEvent.
+type messageFields struct {
+	signer    *service.InterpolatedString
+	signature *service.InterpolatedString
+	payload   *service.InterpolatedString
+	envelope  *envelopeCanonicalizer
+	jcs       bool
+}
+
+// newMessageFields parses the optional field overrides from the processor config.
+func newMessageFields(conf *service.ParsedConfig) (messageFields, error) {
+	var fields messageFields
+	var err error
+	if conf.Contains(signerField) {
+		if fields.signer, err = conf.FieldInterpolatedString(signerField); err != nil {
+			return fields, fmt.Errorf("failed to parse signer field: %w", err)
+		}
+	}
+	if conf.Contains(signatureField) {
+		if fields.signature, err = conf.FieldInterpolatedString(signatureField); err != nil {
+			return fields, fmt.Errorf("failed to parse signature field: %w", err)
+		}
+	}
+	if conf.Contains(payloadField) {
+		if fields.payload, err = conf.FieldInterpolatedString(payloadField); err != nil {
+			return fields, fmt.Errorf("failed to parse payload field: %w", err)
+		}
+	}
+	if conf.Contains(envelopeField) {
+		if fields.payload != nil {
+			return fields, fmt.Errorf("the payload and envelope fields can not both be set")
+		}
+		if fields.envelope, err = newEnvelopeCanonicalizer(conf.Namespace(envelopeField)); err != nil {
+			return fields, fmt.Errorf("failed to parse envelope field: %w", err)
+		}
+	}
+	canonicalization, err := conf.FieldString(canonicalizationField)
+	if err != nil {
+		return fields, fmt.Errorf("failed to parse canonicalization field: %w", err)
+	}
+	fields.jcs = canonicalization == canonicalizationJCS
+	return fields, nil
+}
+
+// extract evaluates the configured fields against msg.
+func (f messageFields) extract(msg *service.Message) (*signedMessage, error) {
+	var event *Event
+	if f.signer == nil || f.signature == nil || f.payload == nil {
+		payload, err := msg.AsBytes()
+		if err != nil {
+			return nil, reject(reasonMalformedMessage, err)
+		}
+		event = &Event{}
+		err = json.Unmarshal(payload, event)
+		if err != nil {
+			return nil, reject(reasonMalformedJSON, err)
+		}
+	}
+
+	var signed signedMessage
+	if f.signer == nil {
+		signed.signer = common.HexToAddress(event.Subject)
+	} else {
+		signer, err := f.signer.TryString(msg)
+		if err != nil {
+			return nil, reject(reasonMalformedMessage, fmt.Errorf("failed to evaluate signer: %w", err))
+		}
+		if !common.IsHexAddress(signer) {
+			return nil, reject(reasonMalformedMessage, fmt.Errorf("signer is not a valid hexadecimal address: %s", signer))
+		}
+		signed.signer = common.HexToAddress(signer)
+	}
+
+	if f.signature == nil {
+		signed.signature = common.FromHex(event.Signature)
+	} else {
+		signature, err := f.signature.TryString(msg)
+		if err != nil {
+			return nil, reject(reasonMalformedMessage, fmt.Errorf("failed to evaluate signature: %w", err))
+		}
+		signed.signature = common.FromHex(signature)
+	}
+
+	switch {
+	case f.envelope != nil:
+		payload, err := msg.AsBytes()
+		if err != nil {
+			return nil, reject(reasonMalformedMessage, err)
+		}
+		if signed.payload, err = f.envelope.canonicalize(payload); err != nil {
+			return nil, reject(reasonMalformedJSON, err)
+		}
+	case f.payload == nil:
+		signed.payload = event.Data
+	default:
+		payload, err := f.payload.TryBytes(msg)
+		if err != nil {
+			return nil, reject(reasonMalformedMessage, fmt.Errorf("failed to evaluate payload: %w", err))
+		}
+		signed.payload = payload
+	}
+
+	if f.jcs {
+		payload, err := canonicalizeJSON(signed.payload)
+		if err != nil {
+			return nil, reject(reasonMalformedJSON, fmt.Errorf("failed to canonicalize payload: %w", err))
+		}
+		signed.payload = payload
+	}
+	return &signed, nil
+}
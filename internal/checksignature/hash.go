@@ -0,0 +1,51 @@
+package checksignature
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// eip191Prefix is prepended to personal messages before hashing, followed by the message length.
+const eip191Prefix = "\x19Ethereum Signed Message:\n%d"
+
+// hashScheme determines how the signed payload is hashed before the signer is recovered.
+type hashScheme string
+
+const (
+	// hashSchemeRaw hashes the payload bytes directly with keccak256.
+	hashSchemeRaw hashScheme = "raw"
+	// hashSchemeEIP191 hashes the payload as an EIP-191 personal message,
+	// which is what wallets produce for personal_sign.
+	hashSchemeEIP191 hashScheme = "eip191"
+	// hashSchemeEIP712 hashes the payload as EIP-712 typed data using the configured domain and types.
+	hashSchemeEIP712 hashScheme = "eip712"
+)
+
+// parseHashScheme converts a configured scheme name into a hashScheme.
+func parseHashScheme(name string) (hashScheme, error) {
+	switch scheme := hashScheme(name); scheme {
+	case hashSchemeRaw, hashSchemeEIP191, hashSchemeEIP712:
+		return scheme, nil
+	default:
+		return "", fmt.Errorf("unknown hash scheme '%s'", name)
+	}
+}
+
+// hash returns the digest of data that the signer is expected to have signed.
+// typedData is only used by the eip712 scheme.
+func (h hashScheme) hash(data []byte, typedData *typedDataHasher) (common.Hash, error) {
+	switch h {
+	case hashSchemeEIP191:
+		prefix := fmt.Sprintf(eip191Prefix, len(data))
+		return crypto.Keccak256Hash([]byte(prefix), data), nil
+	case hashSchemeEIP712:
+		if typedData == nil {
+			return common.Hash{}, fmt.Errorf("no typed data definition configured")
+		}
+		return typedData.hash(data)
+	default:
+		return crypto.Keccak256Hash(data), nil
+	}
+}
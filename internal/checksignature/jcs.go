@@ -0,0 +1,208 @@
+package checksignature
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const canonicalizationField = "canonicalization"
+
+// Canonicalization modes.
+const (
+	canonicalizationNone = "none"
+	canonicalizationJCS  = "jcs"
+)
+
+var canonicalizationConfigField = service.NewStringAnnotatedEnumField(canonicalizationField, map[string]string{
+	canonicalizationNone: "The signed bytes are hashed exactly as they appear in the message.",
+	canonicalizationJCS: "The signed bytes are parsed as JSON and re-encoded with the JSON Canonicalization Scheme (RFC 8785) before hashing, " +
+		"so that signatures survive changes to whitespace, key order and number formatting.",
+}).Description("How the signed bytes are normalized before hashing.").Default(canonicalizationNone)
+
+// canonicalizeJSON re-encodes the JSON value in data following RFC 8785.
+// Objects with duplicate member names are rejected, as RFC 8785 only accepts I-JSON.
+func canonicalizeJSON(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	value, err := decodeIJSON(decoder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %w", err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unexpected data after JSON value")
+	}
+	var buf bytes.Buffer
+	if err := writeCanonicalJSON(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeIJSON decodes the next JSON value of decoder and fails on duplicate member names at any depth.
+// encoding/json would keep the last duplicate while other parsers such as gjson read the first one,
+// so a duplicate could change what downstream consumers see without invalidating the signature.
+func decodeIJSON(decoder *json.Decoder) (any, error) {
+	tok, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := map[string]any{}
+		for decoder.More() {
+			keyTok, err := decoder.Token()
+			if err != nil {
+				return nil, err
+			}
+			key := keyTok.(string)
+			if _, ok := obj[key]; ok {
+				return nil, fmt.Errorf("duplicate member name '%s'", key)
+			}
+			if obj[key], err = decodeIJSON(decoder); err != nil {
+				return nil, err
+			}
+		}
+		// Consume the closing brace.
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case json.Delim('['):
+		arr := []any{}
+		for decoder.More() {
+			elem, err := decodeIJSON(decoder)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, elem)
+		}
+		// Consume the closing bracket.
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+		return arr, nil
+	default:
+		return tok, nil
+	}
+}
+
+func writeCanonicalJSON(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		num, err := canonicalNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(num)
+	case string:
+		writeCanonicalString(buf, v)
+	case []any:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		// Properties are sorted by their UTF-16 code units.
+		slices.SortFunc(keys, func(a, b string) int {
+			return slices.Compare(utf16.Encode([]rune(a)), utf16.Encode([]rune(b)))
+		})
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected JSON value of type %T", value)
+	}
+	return nil
+}
+
+// canonicalNumber formats num as an IEEE 754 double the way ECMAScript does.
+func canonicalNumber(num json.Number) (string, error) {
+	f, err := strconv.ParseFloat(num.String(), 64)
+	if err != nil {
+		return "", fmt.Errorf("number %s can not be represented as a double: %w", num, err)
+	}
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("number %s can not be represented as a double", num)
+	}
+	if f == 0 {
+		// Also covers negative zero.
+		return "0", nil
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs < 1e-6 || abs >= 1e21 {
+		format = 'e'
+	}
+	str := strconv.FormatFloat(f, format, -1, 64)
+	if format == 'e' {
+		// ECMAScript uses the shortest exponent, e-07 becomes e-7.
+		if n := len(str); n >= 4 && str[n-4] == 'e' && str[n-3] == '-' && str[n-2] == '0' {
+			str = str[:n-2] + str[n-1:]
+		}
+	}
+	return str, nil
+}
+
+// writeCanonicalString writes s as a JSON string, only escaping the characters that RFC 8785 requires.
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[r>>4])
+				buf.WriteByte(hex[r&0xf])
+				continue
+			}
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+}
@@ -0,0 +1,81 @@
+package checksignature
+
+import (
+	"errors"
+)
+
+const (
+	rejectedMetric = "check_signature_rejected"
+	verifiedMetric = "check_signature_verified"
+	reasonLabel    = "reason"
+)
+
+// rejectionReason classifies why a message failed verification.
+type rejectionReason string
+
+const (
+	// reasonMalformedJSON is used when the message or its signed bytes are not valid JSON.
+	reasonMalformedJSON rejectionReason = "malformed_json"
+	// reasonMalformedMessage is used when the signer, signature or timestamp can not be read from the message.
+	reasonMalformedMessage rejectionReason = "malformed_message"
+	// reasonSignatureLength is used when a secp256k1 signature is not 65 bytes long.
+	reasonSignatureLength rejectionReason = "invalid_signature_length"
+	// reasonRecoveryID is used when the last byte of a secp256k1 signature is not 27 or 28.
+	reasonRecoveryID rejectionReason = "invalid_recovery_id"
+	// reasonInvalidSignature is used when a well-formed signature does not verify.
+	reasonInvalidSignature rejectionReason = "invalid_signature"
+	// reasonAddressMismatch is used when the recovered address is not allowed to sign for the subject.
+	reasonAddressMismatch rejectionReason = "address_mismatch"
+	// reasonUnknownSigner is used when no public key of the configured algorithm is known for the signer.
+	reasonUnknownSigner rejectionReason = "unknown_signer"
+	// reasonSignerLookupFailed is used when the authorized signers of the subject could not be resolved.
+	reasonSignerLookupFailed rejectionReason = "signer_lookup_failed"
+	// reasonDeniedSigner is used when the signer is on the deny list.
+	reasonDeniedSigner rejectionReason = "denied_signer"
+	// reasonReplay is used when the message was already seen.
+	reasonReplay rejectionReason = "replay"
+	// reasonClockSkew is used when the message timestamp is outside of the allowed clock skew.
+	reasonClockSkew rejectionReason = "clock_skew"
+	// reasonError is used for failures that say nothing about the message, such as an unreachable RPC endpoint.
+	reasonError rejectionReason = "error"
+)
+
+// rejectionError is a verification failure annotated with its reason.
+type rejectionError struct {
+	reason rejectionReason
+	err    error
+}
+
+// reject annotates err with reason.
+func reject(reason rejectionReason, err error) error {
+	return &rejectionError{reason: reason, err: err}
+}
+
+func (r *rejectionError) Error() string {
+	return r.err.Error()
+}
+
+func (r *rejectionError) Unwrap() error {
+	return r.err
+}
+
+// rejectionReasonOf returns the reason of the outermost rejectionError in err, or reasonError if there is none.
+func rejectionReasonOf(err error) rejectionReason {
+	var rejection *rejectionError
+	if errors.As(err, &rejection) {
+		return rejection.reason
+	}
+	return reasonError
+}
+
+// recoverFailureReason classifies a secp256k1 signature from which no address could be recovered.
+func recoverFailureReason(sig []byte) rejectionReason {
+	switch {
+	case len(sig) != sigLen:
+		return reasonSignatureLength
+	case sig[sigLen-1] != 27 && sig[sigLen-1] != 28:
+		return reasonRecoveryID
+	default:
+		return reasonInvalidSignature
+	}
+}
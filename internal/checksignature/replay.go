@@ -0,0 +1,157 @@
+package checksignature
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	replayField           = "replay_protection"
+	replayTTLField        = "ttl"
+	replayMaxEntriesField = "max_entries"
+	replayClockSkewField  = "max_clock_skew"
+	replayTimestampField  = "timestamp"
+)
+
+var replayConfigField = service.NewObjectField(replayField,
+	service.NewDurationField(replayTTLField).
+		Description("How long a verified message is remembered. When `max_clock_skew` is set this should be at least twice as long.").
+		Default("1h"),
+	service.NewIntField(replayMaxEntriesField).
+		Description("Maximum number of messages remembered, the oldest are forgotten first.").
+		Default(1_000_000),
+	service.NewDurationField(replayClockSkewField).
+		Description("Reject messages whose timestamp is further than this from the current time. Zero disables the check.").
+		Default("0s"),
+	service.NewInterpolatedStringField(replayTimestampField).
+		Description("RFC3339 timestamp of the message, used for the clock skew check.").
+		Default(`${!json("time")}`),
+).Description("If set, messages whose signed payload was already verified for the same signer are rejected, " +
+	"even if they carry a different encoding of the signature.").Optional()
+
+// replayGuard rejects messages that were already seen and messages outside of the clock skew window.
+type replayGuard struct {
+	seen      *seenStore
+	clockSkew time.Duration
+	timestamp *service.InterpolatedString
+	now       func() time.Time
+}
+
+// newReplayGuard creates a replayGuard from the replay_protection namespace of the processor config.
+func newReplayGuard(conf *service.ParsedConfig) (*replayGuard, error) {
+	ttl, err := conf.FieldDuration(replayTTLField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ttl: %w", err)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("ttl must be positive")
+	}
+	maxEntries, err := conf.FieldInt(replayMaxEntriesField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse max entries: %w", err)
+	}
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("max entries must be positive")
+	}
+	clockSkew, err := conf.FieldDuration(replayClockSkewField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse max clock skew: %w", err)
+	}
+	timestamp, err := conf.FieldInterpolatedString(replayTimestampField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timestamp: %w", err)
+	}
+	return &replayGuard{
+		seen:      newSeenStore(ttl, maxEntries),
+		clockSkew: clockSkew,
+		timestamp: timestamp,
+		now:       time.Now,
+	}, nil
+}
+
+// check records a verified message and fails if it was seen before
+// or if the message timestamp is outside of the allowed clock skew.
+func (r *replayGuard) check(msg *service.Message, signed *signedMessage) error {
+	now := r.now()
+	if r.clockSkew > 0 {
+		tsStr, err := r.timestamp.TryString(msg)
+		if err != nil {
+			return reject(reasonMalformedMessage, fmt.Errorf("failed to evaluate timestamp: %w", err))
+		}
+		ts, err := time.Parse(time.RFC3339, tsStr)
+		if err != nil {
+			return reject(reasonMalformedMessage, fmt.Errorf("invalid timestamp format: %w", err))
+		}
+		if skew := now.Sub(ts).Abs(); skew > r.clockSkew {
+			return reject(reasonClockSkew, fmt.Errorf("message timestamp %s is outside of the allowed clock skew", tsStr))
+		}
+	}
+
+	// Key on what was signed rather than on the signature, ECDSA signatures can be altered
+	// without invalidating them.
+	key := crypto.Keccak256Hash(signed.signer.Bytes(), crypto.Keccak256(signed.payload))
+	if !r.seen.add(key, now) {
+		return reject(reasonReplay, fmt.Errorf("message was already verified"))
+	}
+	return nil
+}
+
+// seenStore is a bounded set of keys that expire after a fixed ttl.
+// Because every key has the same ttl, insertion order is also expiry order.
+type seenStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	order      *list.List
+	entries    map[common.Hash]*list.Element
+}
+
+type seenEntry struct {
+	key     common.Hash
+	expires time.Time
+}
+
+func newSeenStore(ttl time.Duration, maxEntries int) *seenStore {
+	return &seenStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[common.Hash]*list.Element{},
+	}
+}
+
+// add stores key and reports whether it was not already present.
+func (s *seenStore) add(key common.Hash, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for front := s.order.Front(); front != nil && !now.Before(front.Value.(seenEntry).expires); front = s.order.Front() {
+		s.remove(front)
+	}
+	if _, ok := s.entries[key]; ok {
+		return false
+	}
+	for s.order.Len() >= s.maxEntries {
+		s.remove(s.order.Front())
+	}
+	s.entries[key] = s.order.PushBack(seenEntry{key: key, expires: now.Add(s.ttl)})
+	return true
+}
+
+func (s *seenStore) remove(elem *list.Element) {
+	s.order.Remove(elem)
+	delete(s.entries, elem.Value.(seenEntry).key)
+}
+
+// len returns the number of stored keys.
+func (s *seenStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
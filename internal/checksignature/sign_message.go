@@ -0,0 +1,206 @@
+package checksignature
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	signPluginName      = "sign_message"
+	privateKeyFileField = "private_key_file"
+	privateKeyEnvField  = "private_key_env"
+)
+
+var signConfigSpec = service.NewConfigSpec().
+	Description("Signs the `data` or the envelope of a CloudEvent and sets its `signature` and `subject` fields. " +
+		"The result is accepted by `check_signature` configured with the same hash scheme.").
+	Field(service.NewStringField(privateKeyFileField).
+		Description("Path to a file containing the hex encoded secp256k1 private key.").
+		Example("./signer.key").
+		Optional()).
+	Field(service.NewStringField(privateKeyEnvField).
+		Description("Name of an environment variable containing the hex encoded secp256k1 private key.").
+		Example("SIGNER_PRIVATE_KEY").
+		Optional()).
+	Field(service.NewStringEnumField(hashSchemeField, string(hashSchemeRaw), string(hashSchemeEIP191), string(hashSchemeEIP712)).
+		Description("How the data is hashed before signing, see `check_signature`.").
+		Default(string(hashSchemeRaw))).
+	Field(eip712ConfigField).
+	Field(envelopeConfigField).
+	Field(canonicalizationConfigField)
+
+type signMessageProcessor struct {
+	key        *ecdsa.PrivateKey
+	subject    common.Address
+	hashScheme hashScheme
+	typedData  *typedDataHasher
+	envelope   *envelopeCanonicalizer
+	jcs        bool
+}
+
+func init() {
+	constructor := func(cfg *service.ParsedConfig, _ *service.Resources) (service.Processor, error) {
+		return signCtor(cfg)
+	}
+	err := service.RegisterProcessor(signPluginName, signConfigSpec, constructor)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func signCtor(cfg *service.ParsedConfig) (*signMessageProcessor, error) {
+	key, err := loadPrivateKey(cfg)
+	if err != nil {
+		return nil, err
+	}
+	schemeName, err := cfg.FieldString(hashSchemeField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse hash scheme field: %w", err)
+	}
+	scheme, err := parseHashScheme(schemeName)
+	if err != nil {
+		return nil, err
+	}
+
+	proc := &signMessageProcessor{
+		key:        key,
+		subject:    crypto.PubkeyToAddress(key.PublicKey),
+		hashScheme: scheme,
+	}
+	if cfg.Contains(eip712Field) {
+		proc.typedData, err = newTypedDataHasher(cfg.Namespace(eip712Field))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse eip712 field: %w", err)
+		}
+	}
+	if cfg.Contains(envelopeField) {
+		proc.envelope, err = newEnvelopeCanonicalizer(cfg.Namespace(envelopeField))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse envelope field: %w", err)
+		}
+	}
+	canonicalization, err := cfg.FieldString(canonicalizationField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse canonicalization field: %w", err)
+	}
+	proc.jcs = canonicalization == canonicalizationJCS
+	if scheme == hashSchemeEIP712 && proc.typedData == nil {
+		return nil, fmt.Errorf("the eip712 field must be set when using the eip712 hash scheme")
+	}
+	return proc, nil
+}
+
+// loadPrivateKey reads the signing key from exactly one of the configured file or environment variable.
+func loadPrivateKey(cfg *service.ParsedConfig) (*ecdsa.PrivateKey, error) {
+	var hexKey string
+	switch {
+	case cfg.Contains(privateKeyFileField) && cfg.Contains(privateKeyEnvField):
+		return nil, fmt.Errorf("only one of %s and %s may be set", privateKeyFileField, privateKeyEnvField)
+	case cfg.Contains(privateKeyFileField):
+		path, err := cfg.FieldString(privateKeyFileField)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key file field: %w", err)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key file: %w", err)
+		}
+		hexKey = string(data)
+	case cfg.Contains(privateKeyEnvField):
+		name, err := cfg.FieldString(privateKeyEnvField)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key env field: %w", err)
+		}
+		var ok bool
+		if hexKey, ok = os.LookupEnv(name); !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+	default:
+		return nil, fmt.Errorf("one of %s or %s must be set", privateKeyFileField, privateKeyEnvField)
+	}
+
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(hexKey), "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return key, nil
+}
+
+// Process signs the data of a CloudEvent, leaving its other fields untouched.
+func (s *signMessageProcessor) Process(_ context.Context, msg *service.Message) (service.MessageBatch, error) {
+	payload, err := msg.AsBytes()
+	if err != nil {
+		return nil, err
+	}
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("failed to parse message as a CloudEvent: %w", err)
+	}
+	data, ok := event["data"]
+	if !ok {
+		return nil, fmt.Errorf("message has no data field")
+	}
+
+	// The event is compacted when it is re-encoded, so sign the compacted data to keep it verifiable.
+	var compactData bytes.Buffer
+	if err := json.Compact(&compactData, data); err != nil {
+		return nil, fmt.Errorf("failed to compact data: %w", err)
+	}
+	event["data"] = compactData.Bytes()
+	event["subject"], _ = json.Marshal(s.subject.Hex())
+
+	signedBytes := compactData.Bytes()
+	if s.envelope != nil {
+		if signedBytes, err = s.envelope.canonicalizeEvent(event); err != nil {
+			return nil, err
+		}
+	}
+	if s.jcs {
+		if signedBytes, err = canonicalizeJSON(signedBytes); err != nil {
+			return nil, fmt.Errorf("failed to canonicalize payload: %w", err)
+		}
+	}
+	signature, err := s.sign(signedBytes)
+	if err != nil {
+		return nil, err
+	}
+	event[signatureField], _ = json.Marshal(hexutil.Encode(signature))
+
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	// HTML escaping would change the signed data bytes.
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(event); err != nil {
+		return nil, fmt.Errorf("failed to encode signed message: %w", err)
+	}
+	msg.SetBytes(bytes.TrimSuffix(out.Bytes(), []byte("\n")))
+	return []*service.Message{msg}, nil
+}
+
+// sign returns the signature of data with the recovery byte set to 27 or 28, as Ecrecover expects.
+func (s *signMessageProcessor) sign(data []byte) ([]byte, error) {
+	hash, err := s.hashScheme.hash(data, s.typedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash data with %s scheme: %w", s.hashScheme, err)
+	}
+	signature, err := crypto.Sign(hash.Bytes(), s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign data: %w", err)
+	}
+	signature[64] += 27
+	return signature, nil
+}
+
+func (s *signMessageProcessor) Close(_ context.Context) error {
+	return nil
+}
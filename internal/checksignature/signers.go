@@ -0,0 +1,219 @@
+package checksignature
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	signersField         = "authorized_signers"
+	signersFileField     = "file"
+	signersURLField      = "url"
+	signersCacheTTLField = "cache_ttl"
+	signersTimeoutField  = "timeout"
+	signersDenyField     = "deny"
+	subjectPlaceholder   = "{subject}"
+)
+
+var signersConfigField = service.NewObjectField(signersField,
+	service.NewStringField(signersFileField).
+		Description("Path to a JSON file that maps subject addresses to the list of addresses allowed to sign for them.").
+		Example("./authorized_signers.json").
+		Optional(),
+	service.NewStringField(signersURLField).
+		Description("URL that returns a JSON list of the addresses allowed to sign for a subject. "+
+			"`"+subjectPlaceholder+"` is replaced with the subject address.").
+		Example("http://identity-api/v1/subjects/"+subjectPlaceholder+"/signers").
+		Optional(),
+	service.NewDurationField(signersCacheTTLField).
+		Description("How long signers fetched from the url are cached. Zero disables the cache, so that every message fetches the signers.").
+		Default("10m"),
+	service.NewDurationField(signersTimeoutField).
+		Description("Maximum time to wait for the url to respond. Zero only applies the deadline of the message context.").
+		Default("5s"),
+	service.NewStringListField(signersDenyField).
+		Description("Addresses whose signatures are always rejected, even when they sign for themselves.").
+		Default([]string{}),
+).Description("Accept signatures from addresses other than the subject, such as the owner of a paired vehicle. " +
+	"With an `algorithm` other than `" + algorithmSecp256k1 + "` only the deny list is supported.").Optional()
+
+// SignerResolver returns the addresses other than the subject itself that are authorized to sign for the subject.
+type SignerResolver interface {
+	AuthorizedSigners(ctx context.Context, subject common.Address) ([]common.Address, error)
+}
+
+// signerPolicy decides whether a recovered address may sign for a subject.
+type signerPolicy struct {
+	resolvers []SignerResolver
+	denied    map[common.Address]struct{}
+}
+
+// newSignerPolicy creates a signerPolicy from the authorized_signers namespace of the processor config.
+func newSignerPolicy(conf *service.ParsedConfig) (*signerPolicy, error) {
+	policy := &signerPolicy{denied: map[common.Address]struct{}{}}
+
+	if conf.Contains(signersFileField) {
+		path, err := conf.FieldString(signersFileField)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse file: %w", err)
+		}
+		resolver, err := newStaticSignerResolver(path)
+		if err != nil {
+			return nil, err
+		}
+		policy.resolvers = append(policy.resolvers, resolver)
+	}
+	if conf.Contains(signersURLField) {
+		rawURL, err := conf.FieldString(signersURLField)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse url: %w", err)
+		}
+		if !strings.Contains(rawURL, subjectPlaceholder) {
+			return nil, fmt.Errorf("url must contain the %s placeholder", subjectPlaceholder)
+		}
+		ttl, err := conf.FieldDuration(signersCacheTTLField)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse cache ttl: %w", err)
+		}
+		timeout, err := conf.FieldDuration(signersTimeoutField)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse timeout: %w", err)
+		}
+		policy.resolvers = append(policy.resolvers, newHTTPSignerResolver(rawURL, &http.Client{Timeout: timeout}, ttl))
+	}
+
+	denied, err := conf.FieldStringList(signersDenyField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse deny list: %w", err)
+	}
+	for _, addr := range denied {
+		if !common.IsHexAddress(addr) {
+			return nil, fmt.Errorf("denied address is not a valid hexadecimal address: %s", addr)
+		}
+		policy.denied[common.HexToAddress(addr)] = struct{}{}
+	}
+	return policy, nil
+}
+
+// authorized reports whether signer may sign for subject.
+// A nil policy only allows subjects to sign for themselves.
+func (p *signerPolicy) authorized(ctx context.Context, subject, signer common.Address) (bool, error) {
+	if p.denies(signer) {
+		return false, reject(reasonDeniedSigner, fmt.Errorf("signer %s is denied", signer))
+	}
+	if signer == subject {
+		return true, nil
+	}
+	if p == nil {
+		return false, nil
+	}
+	for _, resolver := range p.resolvers {
+		signers, err := resolver.AuthorizedSigners(ctx, subject)
+		if err != nil {
+			return false, reject(reasonSignerLookupFailed, fmt.Errorf("failed to resolve authorized signers for %s: %w", subject, err))
+		}
+		if slices.Contains(signers, signer) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// denies reports whether addr is on the deny list.
+func (p *signerPolicy) denies(addr common.Address) bool {
+	if p == nil {
+		return false
+	}
+	_, ok := p.denied[addr]
+	return ok
+}
+
+// staticSignerResolver resolves authorized signers from a fixed mapping.
+type staticSignerResolver struct {
+	signers map[common.Address][]common.Address
+}
+
+// newStaticSignerResolver loads a JSON object mapping subject addresses to lists of signer addresses.
+func newStaticSignerResolver(path string) (*staticSignerResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized signers file: %w", err)
+	}
+	var signers map[common.Address][]common.Address
+	if err := json.Unmarshal(data, &signers); err != nil {
+		return nil, fmt.Errorf("failed to parse authorized signers file: %w", err)
+	}
+	return &staticSignerResolver{signers: signers}, nil
+}
+
+// AuthorizedSigners returns the signers listed for subject.
+func (s *staticSignerResolver) AuthorizedSigners(_ context.Context, subject common.Address) ([]common.Address, error) {
+	return s.signers[subject], nil
+}
+
+// httpSignerResolver fetches authorized signers from an HTTP endpoint and caches the result per subject.
+type httpSignerResolver struct {
+	urlTemplate string
+	client      *http.Client
+	// cache is nil when caching is disabled.
+	cache *gocache.Cache
+}
+
+// newHTTPSignerResolver creates an httpSignerResolver that caches signers for ttl, or not at all if ttl is not positive.
+func newHTTPSignerResolver(urlTemplate string, client *http.Client, ttl time.Duration) *httpSignerResolver {
+	resolver := &httpSignerResolver{
+		urlTemplate: urlTemplate,
+		client:      client,
+	}
+	if ttl > 0 {
+		resolver.cache = gocache.New(ttl, 2*ttl)
+	}
+	return resolver
+}
+
+// AuthorizedSigners returns the cached signers for subject, fetching them when they are not cached.
+// A 404 response is cached as an empty list.
+func (h *httpSignerResolver) AuthorizedSigners(ctx context.Context, subject common.Address) ([]common.Address, error) {
+	if h.cache != nil {
+		if cached, found := h.cache.Get(subject.Hex()); found {
+			return cached.([]common.Address), nil
+		}
+	}
+
+	reqURL := strings.ReplaceAll(h.urlTemplate, subjectPlaceholder, url.PathEscape(subject.Hex()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var signers []common.Address
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(&signers); err != nil {
+			return nil, fmt.Errorf("failed to decode response: %w", err)
+		}
+	case http.StatusNotFound:
+	default:
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	if h.cache != nil {
+		h.cache.SetDefault(subject.Hex(), signers)
+	}
+	return signers, nil
+}
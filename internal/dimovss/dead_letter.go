@@ -0,0 +1,64 @@
+package dimovss
+
+import (
+	"github.com/DIMO-Network/model-garage/pkg/nativestatus"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"golang.org/x/mod/semver"
+)
+
+const (
+	deadLetterFieldName = "dead_letter"
+
+	// Metadata set on dead-lettered messages.
+	metaDropReason    = "dimo_drop_reason"
+	metaDropError     = "dimo_drop_error"
+	metaSubject       = "dimo_subject"
+	metaSchemaVersion = "dimo_schema_version"
+)
+
+// Reasons for dead-lettering a message.
+const (
+	dropReasonTokenNotFound   = "token_not_found"
+	dropReasonConverted       = "converted_payload"
+	dropReasonConversionError = "conversion_error"
+	dropReasonError           = "processing_error"
+)
+
+var deadLetterField = service.NewBoolField(deadLetterFieldName).
+	Description("Emit every dropped or partially failed input message with its original bytes instead of dropping it, " +
+		"so that it can be routed to a dead-letter topic and replayed later. The message gets the metadata `" +
+		metaDropReason + "` (`" + dropReasonTokenNotFound + "`, `" + dropReasonConverted + "`, `" +
+		dropReasonConversionError + "` or `" + dropReasonError + "`), `" + metaDropError + "`, `" + metaSubject +
+		"` and `" + metaSchemaVersion + "`. Messages that failed keep their error.").
+	Default(false)
+
+// deadLetter returns a copy of msg, with its original bytes, annotated with why it was dropped.
+func deadLetter(msg *service.Message, reason string, err error) *service.Message {
+	dropped := msg.Copy()
+	dropped.MetaSetMut(metaDropReason, reason)
+	if err != nil {
+		dropped.MetaSetMut(metaDropError, err.Error())
+	}
+	msgBytes, bytesErr := msg.AsBytes()
+	if bytesErr != nil {
+		return dropped
+	}
+	if subject, subjectErr := nativestatus.SubjectFromV1Data(msgBytes); subjectErr == nil {
+		dropped.MetaSetMut(metaSubject, subject)
+	}
+	dropped.MetaSetMut(metaSchemaVersion, schemaVersion(msgBytes))
+	return dropped
+}
+
+// schemaVersion returns the dataschema version of msgBytes as a full semantic version, so that "v1.1" is "v1.1.0".
+// Payloads without a dataschema are v1 payloads. A version that is not semantic is returned as is.
+func schemaVersion(msgBytes []byte) string {
+	version := nativestatus.GetSchemaVersion(msgBytes)
+	if version == "" {
+		return nativestatus.StatusV1
+	}
+	if canonical := semver.Canonical(version); canonical != "" {
+		return canonical
+	}
+	return version
+}
@@ -0,0 +1,249 @@
+package dimovss
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/DIMO-Network/benthos-plugin/internal/service/deviceapi"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const (
+	grpcTLSFieldName         = "devices_api_tls"
+	grpcServerNameFieldName  = "devices_api_server_name"
+	grpcBearerTokenFieldName = "devices_api_bearer_token"
+	grpcTimeoutFieldName     = "devices_api_timeout"
+	grpcRetryFieldName       = "devices_api_retry"
+	grpcBreakerFieldName     = "devices_api_circuit_breaker"
+	grpcCacheFieldName       = "devices_api_cache"
+	grpcConcurrencyFieldName = "devices_api_lookup_concurrency"
+
+	cacheSnapshotField     = "snapshot"
+	cacheEvictedMetricName = "vss_vehicle_token_cache_evicted"
+)
+
+func devicesAPIFields() []*service.ConfigField {
+	tlsField := service.NewTLSToggledField(grpcTLSFieldName)
+	tlsField.Description("TLS settings of the devices API gRPC connection. The connection is plaintext unless enabled.")
+	serverNameField := service.NewStringField(grpcServerNameFieldName)
+	serverNameField.Default("")
+	serverNameField.Description("Overrides the server name used to verify the devices API certificate, for when the address is not the name in the certificate.")
+	serverNameField.Advanced()
+	tokenField := service.NewStringField(grpcBearerTokenFieldName)
+	tokenField.Default("")
+	tokenField.Description("If set, sent as a bearer token in the authorization metadata of every devices API call. Requires `" + grpcTLSFieldName + ".enabled`.")
+	tokenField.Secret()
+	defaults := deviceapi.DefaultConfig()
+	timeoutField := service.NewDurationField(grpcTimeoutFieldName)
+	timeoutField.Default(defaults.Timeout.String())
+	timeoutField.Description("Maximum duration of a single devices API call.")
+	retryField := service.NewObjectField(grpcRetryFieldName,
+		service.NewIntField("max_retries").
+			Description("How many times a call failing with Unavailable, DeadlineExceeded, ResourceExhausted or Aborted is retried.").
+			Default(defaults.MaxRetries),
+		service.NewDurationField("initial_interval").
+			Description("Wait before the first retry, doubled for every further retry.").
+			Default(defaults.InitialBackoff.String()),
+		service.NewDurationField("max_interval").
+			Description("Maximum wait between retries.").
+			Default(defaults.MaxBackoff.String()),
+	)
+	retryField.Description("Retries of failed devices API calls.")
+	retryField.Advanced()
+	breakerField := service.NewObjectField(grpcBreakerFieldName,
+		service.NewIntField("failure_threshold").
+			Description("Number of consecutive failed lookups that opens the breaker. Zero disables the breaker.").
+			Default(defaults.BreakerThreshold),
+		service.NewDurationField("cooldown").
+			Description("How long lookups fail fast once the breaker is open.").
+			Default(defaults.BreakerCooldown.String()),
+	)
+	breakerField.Description("Circuit breaker that stops calling the devices API during an outage.")
+	breakerField.Advanced()
+	cacheField := service.NewObjectField(grpcCacheFieldName,
+		service.NewStringField("name").
+			Description("Name by which `"+cacheUpdatePluginName+"` processors find this cache to apply device lifecycle events.").
+			Default(defaultCacheName),
+		service.NewDurationField("ttl").
+			Description("How long a resolved token ID is cached. Zero disables caching.").
+			Default(defaults.CacheTTL.String()),
+		service.NewIntField("max_size").
+			Description("Maximum number of cached devices. The least recently used device is evicted when the cache is full. Zero leaves the cache unbounded.").
+			Default(defaults.CacheSize),
+		service.NewDurationField("not_found_ttl").
+			Description("How long a device that does not exist or has no token ID is remembered before the devices API is asked again. Zero disables negative caching.").
+			Default(defaults.NotFoundTTL.String()),
+		service.NewObjectField(cacheSnapshotField,
+			service.NewStringField("path").
+				Description("File the cached token IDs are saved to and loaded from on startup.").
+				Example("./token-cache.json"),
+			service.NewDurationField("interval").
+				Description("How often the cache is saved. It is also saved when the processor is closed.").
+				Default("5m"),
+			service.NewDurationField("max_age").
+				Description("A snapshot saved longer ago than this is not loaded, so that a long outage does not resurrect stale token IDs.").
+				Default("1h"),
+		).Description("Saves the cache to a local file so that restarts and scale-outs do not start with an empty cache. "+
+			"The pipeline threads share the cache of a processor, but processors saving to the same path overwrite each other, "+
+			"so give every `"+pluginName+"` processor its own path.").Optional(),
+	)
+	cacheField.Description("Caching of devices API lookups. Evictions are counted by the `" + cacheEvictedMetricName + "` metric.")
+	cacheField.Advanced()
+	concurrencyField := service.NewIntField(grpcConcurrencyFieldName)
+	concurrencyField.Default(defaults.LookupConcurrency)
+	concurrencyField.Description("Maximum number of concurrent devices API calls made to resolve the uncached devices of a batch. Zero leaves it unbounded.")
+	concurrencyField.Advanced()
+	return []*service.ConfigField{tlsField, serverNameField, tokenField, timeoutField, retryField, breakerField, cacheField, concurrencyField}
+}
+
+// devicesAPIConfig reads the devices API call settings from the processor config.
+func devicesAPIConfig(cfg *service.ParsedConfig, metrics *service.Metrics) (deviceapi.Config, error) {
+	var config deviceapi.Config
+	var err error
+	if config.Timeout, err = cfg.FieldDuration(grpcTimeoutFieldName); err != nil {
+		return config, fmt.Errorf("failed to get timeout: %w", err)
+	}
+	if config.MaxRetries, err = cfg.FieldInt(grpcRetryFieldName, "max_retries"); err != nil {
+		return config, fmt.Errorf("failed to get max retries: %w", err)
+	}
+	if config.InitialBackoff, err = cfg.FieldDuration(grpcRetryFieldName, "initial_interval"); err != nil {
+		return config, fmt.Errorf("failed to get initial retry interval: %w", err)
+	}
+	if config.MaxBackoff, err = cfg.FieldDuration(grpcRetryFieldName, "max_interval"); err != nil {
+		return config, fmt.Errorf("failed to get max retry interval: %w", err)
+	}
+	if config.BreakerThreshold, err = cfg.FieldInt(grpcBreakerFieldName, "failure_threshold"); err != nil {
+		return config, fmt.Errorf("failed to get circuit breaker failure threshold: %w", err)
+	}
+	if config.BreakerCooldown, err = cfg.FieldDuration(grpcBreakerFieldName, "cooldown"); err != nil {
+		return config, fmt.Errorf("failed to get circuit breaker cooldown: %w", err)
+	}
+	if config.CacheTTL, err = cfg.FieldDuration(grpcCacheFieldName, "ttl"); err != nil {
+		return config, fmt.Errorf("failed to get cache ttl: %w", err)
+	}
+	if config.CacheSize, err = cfg.FieldInt(grpcCacheFieldName, "max_size"); err != nil {
+		return config, fmt.Errorf("failed to get cache max size: %w", err)
+	}
+	if config.NotFoundTTL, err = cfg.FieldDuration(grpcCacheFieldName, "not_found_ttl"); err != nil {
+		return config, fmt.Errorf("failed to get not found ttl: %w", err)
+	}
+	if config.LookupConcurrency, err = cfg.FieldInt(grpcConcurrencyFieldName); err != nil {
+		return config, fmt.Errorf("failed to get lookup concurrency: %w", err)
+	}
+	evicted := metrics.NewCounter(cacheEvictedMetricName)
+	config.OnEvict = func() { evicted.Incr(1) }
+	return config, nil
+}
+
+// cacheSnapshots are the settings of the devices API cache snapshots.
+type cacheSnapshots struct {
+	path     string
+	interval time.Duration
+	maxAge   time.Duration
+}
+
+// cacheSnapshotsConfig reads the snapshot settings from the devices API cache config.
+// It returns nil if snapshots are not configured.
+func cacheSnapshotsConfig(cfg *service.ParsedConfig) (*cacheSnapshots, error) {
+	if !cfg.Contains(cacheSnapshotField) {
+		return nil, nil
+	}
+	var conf cacheSnapshots
+	var err error
+	if conf.path, err = cfg.FieldString(cacheSnapshotField, "path"); err != nil {
+		return nil, fmt.Errorf("failed to get cache snapshot path: %w", err)
+	}
+	if conf.interval, err = cfg.FieldDuration(cacheSnapshotField, "interval"); err != nil {
+		return nil, fmt.Errorf("failed to get cache snapshot interval: %w", err)
+	}
+	if conf.interval <= 0 {
+		return nil, fmt.Errorf("cache snapshot interval must be positive")
+	}
+	if conf.maxAge, err = cfg.FieldDuration(cacheSnapshotField, "max_age"); err != nil {
+		return nil, fmt.Errorf("failed to get cache snapshot max age: %w", err)
+	}
+	return &conf, nil
+}
+
+// startCacheSnapshots loads the cache snapshot into svc and saves the cache periodically.
+// The returned function stops saving after a final save.
+func startCacheSnapshots(conf *cacheSnapshots, svc *deviceapi.Service, logger *service.Logger) func() {
+	if conf == nil {
+		return func() {}
+	}
+
+	// A missing or broken snapshot only costs devices API lookups, so it does not stop the pipeline.
+	loaded, err := svc.LoadSnapshot(conf.path, conf.maxAge)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("failed to load token cache snapshot: %v", err))
+	} else {
+		logger.Debug(fmt.Sprintf("loaded %d token IDs from cache snapshot %s", loaded, conf.path))
+	}
+
+	return runPeriodically(conf.interval, func() {
+		if err := svc.SaveSnapshot(conf.path); err != nil {
+			logger.Warn(fmt.Sprintf("failed to save token cache snapshot: %v", err))
+		}
+	})
+}
+
+// dialDevicesAPI creates a gRPC client connection to the devices API from the processor config.
+func dialDevicesAPI(cfg *service.ParsedConfig) (*grpc.ClientConn, error) {
+	grpcAddr, err := cfg.FieldString(grpcFieldName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get grpc address: %w", err)
+	}
+	tlsConf, tlsEnabled, err := cfg.FieldTLSToggled(grpcTLSFieldName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tls config: %w", err)
+	}
+	serverName, err := cfg.FieldString(grpcServerNameFieldName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server name: %w", err)
+	}
+	token, err := cfg.FieldString(grpcBearerTokenFieldName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get bearer token: %w", err)
+	}
+
+	if token != "" && !tlsEnabled {
+		return nil, fmt.Errorf("%s requires %s to be enabled", grpcBearerTokenFieldName, grpcTLSFieldName)
+	}
+
+	transportCreds := insecure.NewCredentials()
+	if tlsEnabled {
+		if serverName != "" {
+			tlsConf.ServerName = serverName
+		}
+		transportCreds = credentials.NewTLS(tlsConf)
+	}
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(transportCreds)}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken{token: token}))
+	}
+
+	devicesConn, err := grpc.NewClient(grpcAddr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial devices api: %w", err)
+	}
+	return devicesConn, nil
+}
+
+// bearerToken attaches a static bearer token to every call.
+type bearerToken struct {
+	token string
+}
+
+// GetRequestMetadata returns the authorization metadata of a call.
+func (b bearerToken) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + b.token}, nil
+}
+
+// RequireTransportSecurity reports that the token may only be sent over TLS.
+func (bearerToken) RequireTransportSecurity() bool {
+	return true
+}
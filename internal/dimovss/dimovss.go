@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/DIMO-Network/benthos-plugin/internal/service/deviceapi"
 	"github.com/DIMO-Network/model-garage/pkg/convert"
@@ -15,45 +17,89 @@ import (
 	"github.com/redpanda-data/benthos/v4/public/service"
 	"golang.org/x/mod/semver"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
 const (
 	pluginName         = "vss_vehicle"
 	pluginSummary      = "Converts a Status message from a DIMO device into a list of values for insertion into clickhouse."
 	grpcFieldName      = "devices_api_grpc_addr"
-	grpcFieldDesc      = "The address of the devices API gRPC server."
+	grpcFieldDesc      = "The address of the devices API gRPC server. Required when `token_source.type` is `devices_api`."
 	migrationFieldName = "init_migration"
+	convertedFieldName = "converted_payload_policy"
+
+	convertedDroppedMetricName = "vss_vehicle_converted_dropped"
+)
+
+// Policies for v1.1 payloads that were converted from another format.
+const (
+	convertedPolicyDrop        = "drop"
+	convertedPolicyPassthrough = "passthrough"
+	convertedPolicyConvert     = "convert"
+	convertedPolicyError       = "error"
 )
 
 func init() {
-	// Config spec is empty for now as we don't have any dynamic fields.
+	err := service.RegisterBatchProcessor(pluginName, configSpec(), ctor)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func configSpec() *service.ConfigSpec {
 	grpcField := service.NewStringField(grpcFieldName)
 	grpcField.Description(grpcFieldDesc)
+	grpcField.Optional()
 	chConfig := service.NewStringField(migrationFieldName)
 	chConfig.Default("")
 	chConfig.Description("If set, the plugin will run a database migration on startup. using the provided DNS string.")
-	configSpec := service.NewConfigSpec()
-	configSpec.Summary(pluginSummary)
-	configSpec.Field(grpcField)
-	configSpec.Field(chConfig)
+	spec := service.NewConfigSpec()
+	spec.Summary(pluginSummary)
+	spec.Field(grpcField)
+	spec.Fields(devicesAPIFields()...)
+	spec.Field(chConfig)
+	spec.Field(service.NewStringAnnotatedEnumField(convertedFieldName, map[string]string{
+		convertedPolicyDrop:        "Drop the message and count it in the `" + convertedDroppedMetricName + "` metric.",
+		convertedPolicyPassthrough: "Emit the message unchanged.",
+		convertedPolicyConvert:     "Convert the message like a v1 payload.",
+		convertedPolicyError:       "Fail the message.",
+	}).Description("What to do with v1.1 status messages, which were converted from another format.").
+		Default(convertedPolicyDrop))
+	spec.Field(deadLetterField)
+	spec.Field(tokenSourceField)
+	spec.Field(tokenStatsField)
+	return spec
+}
 
-	err := service.RegisterProcessor(pluginName, configSpec, ctor)
+func ctor(cfg *service.ParsedConfig, mgr *service.Resources) (service.BatchProcessor, error) {
+	dsn, err := cfg.FieldString(migrationFieldName)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("failed to get dsn: %w", err)
 	}
-}
-
-func ctor(cfg *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
-	grpcAddr, err := cfg.FieldString(grpcFieldName)
+	convertedPolicy, err := cfg.FieldString(convertedFieldName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get grpc address: %w", err)
+		return nil, fmt.Errorf("failed to get converted payload policy: %w", err)
 	}
-
-	dsn, err := cfg.FieldString(migrationFieldName)
+	deadLetter, err := cfg.FieldBool(deadLetterFieldName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get dsn: %w", err)
+		return nil, fmt.Errorf("failed to get dead letter: %w", err)
 	}
+	statsConfig, err := tokenStatsConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	summaries, err := statsSummariesConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cacheName, err := cfg.FieldString(grpcCacheFieldName, "name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cache name: %w", err)
+	}
+	snapshots, err := cacheSnapshotsConfig(cfg.Namespace(grpcCacheFieldName))
+	if err != nil {
+		return nil, err
+	}
+
 	if dsn != "" {
 		err = runMigration(dsn)
 		if err != nil {
@@ -61,28 +107,129 @@ func ctor(cfg *service.ParsedConfig, mgr *service.Resources) (service.Processor,
 		}
 	}
 
-	return newVSSProcessor(mgr.Logger(), grpcAddr)
+	// Nothing can fail past this point, so the connection and the background work below are never leaked.
+	tokenGetter, devicesConn, err := newTokenIDGetter(cfg, mgr.Metrics())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token source: %w", err)
+	}
+	limitedGetter := NewLimitedTokenGetterWithConfig(tokenGetter, mgr.Logger(), statsConfig)
+	proc := newVSSProcessor(mgr.Logger(), limitedGetter)
+	proc.convertedPolicy = convertedPolicy
+	proc.convertedDropped = mgr.Metrics().NewCounter(convertedDroppedMetricName)
+	proc.deadLetter = deadLetter
+	proc.devicesConn = devicesConn
+	proc.onClose = append(proc.onClose, startStatsSummaries(summaries, limitedGetter))
+	if svc, ok := tokenGetter.(*deviceapi.Service); ok {
+		proc.onClose = append(proc.onClose, tokenCaches.register(cacheName, svc), startCacheSnapshots(snapshots, svc, mgr.Logger()))
+	}
+	return proc, nil
 }
 
 type vssProcessor struct {
-	logger      *service.Logger
-	tokenGetter nativestatus.TokenIDGetter
+	logger           *service.Logger
+	tokenGetter      nativestatus.TokenIDGetter
+	convertedPolicy  string
+	convertedDropped *service.MetricCounter
+	deadLetter       bool
+	// devicesConn is the devices API connection of the token getter, if it uses one.
+	devicesConn *grpc.ClientConn
+	onClose     []func()
+	closeOnce   sync.Once
 }
 
-func newVSSProcessor(lgr *service.Logger, devicesAPIGRPCAddr string) (*vssProcessor, error) {
-	devicesConn, err := grpc.NewClient(devicesAPIGRPCAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, fmt.Errorf("failed to dial devices api: %w", err)
-	}
-	deviceAPI := deviceapi.NewService(devicesConn)
-	limitedDeviceAPI := NewLimitedTokenGetter(deviceAPI, lgr)
+func newVSSProcessor(lgr *service.Logger, tokenGetter *LimitedTokenGetter) *vssProcessor {
 	return &vssProcessor{
 		logger:      lgr,
-		tokenGetter: limitedDeviceAPI,
-	}, nil
+		tokenGetter: tokenGetter,
+	}
+}
+
+// ProcessBatch converts every message of the batch. The token IDs of the v1 messages are resolved
+// with one bulk lookup before the messages are converted.
+func (v *vssProcessor) ProcessBatch(ctx context.Context, batch service.MessageBatch) ([]service.MessageBatch, error) {
+	tokenGetter := v.prefetchTokenIDs(ctx, batch)
+	var retMsgs service.MessageBatch
+	for _, msg := range batch {
+		msgs, err := v.process(ctx, tokenGetter, msg)
+		if err != nil {
+			if v.deadLetter {
+				msg = deadLetter(msg, dropReasonError, err)
+			}
+			msg.SetError(err)
+			retMsgs = append(retMsgs, msg)
+			continue
+		}
+		retMsgs = append(retMsgs, msgs...)
+	}
+	if len(retMsgs) == 0 {
+		return nil, nil
+	}
+	return []service.MessageBatch{retMsgs}, nil
 }
 
+// Process converts a single message.
 func (v *vssProcessor) Process(ctx context.Context, msg *service.Message) (service.MessageBatch, error) {
+	return v.process(ctx, v.tokenGetter, msg)
+}
+
+// prefetchTokenIDs resolves the token IDs of the distinct v1 subjects in batch with one lookup and returns
+// a TokenIDGetter answering from the result. Without a BatchTokenIDGetter the processor's getter is returned.
+// Subjects of v1.1 payloads are only resolved if the converted payload policy converts them.
+func (v *vssProcessor) prefetchTokenIDs(ctx context.Context, batch service.MessageBatch) nativestatus.TokenIDGetter {
+	batchGetter, ok := v.tokenGetter.(BatchTokenIDGetter)
+	if !ok {
+		return v.tokenGetter
+	}
+	var subjects []string
+	seen := map[string]struct{}{}
+	for _, msg := range batch {
+		msgBytes, err := msg.AsBytes()
+		if err != nil {
+			continue
+		}
+		// v1 payloads may have no dataschema at all.
+		schemaVersion := nativestatus.GetSchemaVersion(msgBytes)
+		isV1 := schemaVersion == "" || semver.Compare(nativestatus.StatusV1, schemaVersion) == 0
+		isConverted := semver.Compare(nativestatus.StatusV1Converted, schemaVersion) == 0
+		if !isV1 && (!isConverted || v.convertedPolicy != convertedPolicyConvert) {
+			continue
+		}
+		subject, err := nativestatus.SubjectFromV1Data(msgBytes)
+		if err != nil {
+			continue
+		}
+		if _, ok := seen[subject]; ok {
+			continue
+		}
+		seen[subject] = struct{}{}
+		subjects = append(subjects, subject)
+	}
+	if len(subjects) == 0 {
+		return v.tokenGetter
+	}
+	tokenIDs, errs := batchGetter.TokenIDsFromSubjects(ctx, subjects)
+	return &resolvedTokenGetter{tokenIDs: tokenIDs, errs: errs, fallback: v.tokenGetter}
+}
+
+// resolvedTokenGetter answers from the results of a bulk lookup and falls back to another getter for other subjects.
+type resolvedTokenGetter struct {
+	tokenIDs map[string]uint32
+	errs     map[string]error
+	fallback nativestatus.TokenIDGetter
+}
+
+// TokenIDFromSubject returns the looked up token ID of subject.
+func (r *resolvedTokenGetter) TokenIDFromSubject(ctx context.Context, subject string) (uint32, error) {
+	if tokenID, ok := r.tokenIDs[subject]; ok {
+		return tokenID, nil
+	}
+	if err, ok := r.errs[subject]; ok {
+		return 0, err
+	}
+	return r.fallback.TokenIDFromSubject(ctx, subject)
+}
+
+func (v *vssProcessor) process(ctx context.Context, tokenGetter nativestatus.TokenIDGetter, msg *service.Message) (service.MessageBatch, error) {
 	// Get the JSON message and convert it to a DIMO status.
 	msgBytes, err := msg.AsBytes()
 	if err != nil {
@@ -90,16 +237,31 @@ func (v *vssProcessor) Process(ctx context.Context, msg *service.Message) (servi
 	}
 	schemaVersion := nativestatus.GetSchemaVersion(msgBytes)
 	if semver.Compare(nativestatus.StatusV1Converted, schemaVersion) == 0 {
-		// ignore v1.1 messages
-		return nil, nil
+		switch v.convertedPolicy {
+		case convertedPolicyPassthrough:
+			return service.MessageBatch{msg}, nil
+		case convertedPolicyError:
+			return nil, fmt.Errorf("converted payloads with schema version %s are not accepted", schemaVersion)
+		case convertedPolicyConvert:
+			// v1.1 payloads have the v1 schema and are converted like one.
+		default:
+			v.convertedDropped.Incr(1)
+			if v.deadLetter {
+				return service.MessageBatch{deadLetter(msg, dropReasonConverted, nil)}, nil
+			}
+			return nil, nil
+		}
 	}
 	var partialErr *service.Message
 	var retMsgs service.MessageBatch
-	signals, err := nativestatus.SignalsFromPayload(ctx, v.tokenGetter, msgBytes)
+	signals, err := nativestatus.SignalsFromPayload(ctx, tokenGetter, msgBytes)
 	if err != nil {
 		if errors.As(err, &deviceapi.NotFoundError{}) {
 			// If we do not have an Token for this device we want to drop the message. But we don't want to log an error.
 			v.logger.Trace(fmt.Sprintf("dropping message: %v", err))
+			if v.deadLetter {
+				return service.MessageBatch{deadLetter(msg, dropReasonTokenNotFound, err)}, nil
+			}
 			return nil, nil
 		}
 
@@ -109,13 +271,18 @@ func (v *vssProcessor) Process(ctx context.Context, msg *service.Message) (servi
 		}
 		// if we have a conversion error we will add a error message with metadata to the batch.
 		// but still return the signals that we could decode.
-		partialErr = msg.Copy()
-		partialErr.SetError(err)
-		data, err := json.Marshal(convertErr)
-		if err == nil {
-			partialErr.SetBytes(data)
+		if v.deadLetter {
+			partialErr = deadLetter(msg, dropReasonConversionError, err)
+			partialErr.SetError(err)
 		} else {
-			partialErr.SetBytes(nil)
+			partialErr = msg.Copy()
+			partialErr.SetError(err)
+			data, err := json.Marshal(convertErr)
+			if err == nil {
+				partialErr.SetBytes(data)
+			} else {
+				partialErr.SetBytes(nil)
+			}
 		}
 		retMsgs = append(retMsgs, partialErr)
 		signals = convertErr.DecodedSignals
@@ -131,9 +298,45 @@ func (v *vssProcessor) Process(ctx context.Context, msg *service.Message) (servi
 	return retMsgs, nil
 }
 
-// Close does nothing because our processor doesn't need to clean up resources.
-func (*vssProcessor) Close(context.Context) error {
-	return nil
+// Close stops the background work of the processor, such as the token cache snapshots and stats summaries,
+// and closes the devices API connection. Calling it again does nothing.
+func (v *vssProcessor) Close(context.Context) error {
+	var err error
+	v.closeOnce.Do(func() {
+		for _, fn := range v.onClose {
+			fn()
+		}
+		if v.devicesConn != nil {
+			if closeErr := v.devicesConn.Close(); closeErr != nil {
+				err = fmt.Errorf("failed to close devices api connection: %w", closeErr)
+			}
+		}
+	})
+	return err
+}
+
+// runPeriodically calls fn every interval until the returned function is called, which calls fn a final time.
+func runPeriodically(interval time.Duration, fn func()) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fn()
+			case <-stop:
+				fn()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
 }
 
 func runMigration(dsn string) error {
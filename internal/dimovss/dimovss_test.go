@@ -2,16 +2,38 @@ package dimovss
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/DIMO-Network/benthos-plugin/internal/service/deviceapi"
+	pb "github.com/DIMO-Network/devices-api/pkg/grpc"
 	"github.com/DIMO-Network/model-garage/pkg/vss"
 	"github.com/redpanda-data/benthos/v4/public/service"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -139,6 +161,57 @@ func TestVSSProcessorProcess(t *testing.T) {
 	}
 }
 
+func TestVSSProcessorProcessBatch(t *testing.T) {
+	v1Payload := `{"specversion":"1.0", "time": "2024-12-23T12:34:00Z", "source": "source1", "subject": "%s", "data"{"speed": 1.0}}`
+	batch := service.MessageBatch{
+		service.NewMessage([]byte(fmt.Sprintf(v1Payload, "1"))),
+		service.NewMessage([]byte(fmt.Sprintf(v1Payload, "2"))),
+		service.NewMessage([]byte(fmt.Sprintf(v1Payload, "1"))),
+		service.NewMessage([]byte(fmt.Sprintf(v1Payload, notFoundSubject))),
+		service.NewMessage([]byte(fmt.Sprintf(v1Payload, errorSubject))),
+		service.NewMessage([]byte(`{"dataschema":"v2.0", "specversion":"1.0", "vehicleTokenId": 3, "source": "source1", "data": {"vehicle": {"signals": [{"name": "speed", "timestamp": 1734957240000, "value": 1.0}]}}}`)),
+		service.NewMessage([]byte(`{"specversion":"1.0","dataschema":"dimo.zone.status/v1.1", "source": "source1", "time": "2024-12-23T12:34:00Z", "subject": "4", "data"{"speed": 1.0}}`)),
+	}
+	getter := &batchTestGetter{}
+	vssProc := &vssProcessor{tokenGetter: getter}
+
+	batches, err := vssProc.ProcessBatch(context.Background(), batch)
+	require.NoError(t, err)
+	require.Len(t, batches, 1)
+
+	// The distinct v1 subjects are resolved once, in order of appearance.
+	require.Equal(t, [][]string{{"1", "2", notFoundSubject, errorSubject}}, getter.batches)
+	require.Zero(t, getter.singleCalls)
+
+	var errMsgs int
+	var actualBytes [][]byte
+	for _, msg := range batches[0] {
+		if msg.GetError() != nil {
+			errMsgs++
+			continue
+		}
+		msgBytes, err := msg.AsBytes()
+		require.NoError(t, err)
+		actualBytes = append(actualBytes, msgBytes)
+	}
+	var expectedBytes [][]byte
+	for _, tokenID := range []uint32{1, 2, 1, 3} {
+		msg := service.NewMessage(nil)
+		msg.SetStructured(vss.SignalToSlice(vss.Signal{
+			TokenID:     tokenID,
+			Timestamp:   time.UnixMilli(1734957240000).UTC(),
+			Name:        vss.FieldSpeed,
+			Source:      "source1",
+			ValueNumber: 1.0,
+		}))
+		msgBytes, err := msg.AsBytes()
+		require.NoError(t, err)
+		expectedBytes = append(expectedBytes, msgBytes)
+	}
+	require.Equal(t, expectedBytes, actualBytes)
+	require.Equal(t, 1, errMsgs)
+}
+
 type testGetter struct{}
 
 func (t *testGetter) TokenIDFromSubject(_ context.Context, subject string) (uint32, error) {
@@ -151,3 +224,670 @@ func (t *testGetter) TokenIDFromSubject(_ context.Context, subject string) (uint
 	id, err := strconv.Atoi(subject)
 	return uint32(id), err
 }
+
+// batchTestGetter is a testGetter that records its bulk lookups.
+type batchTestGetter struct {
+	testGetter
+	batches     [][]string
+	singleCalls int
+}
+
+func (b *batchTestGetter) TokenIDFromSubject(ctx context.Context, subject string) (uint32, error) {
+	b.singleCalls++
+	return b.testGetter.TokenIDFromSubject(ctx, subject)
+}
+
+func (b *batchTestGetter) TokenIDsFromSubjects(ctx context.Context, subjects []string) (map[string]uint32, map[string]error) {
+	b.batches = append(b.batches, subjects)
+	tokenIDs := map[string]uint32{}
+	errs := map[string]error{}
+	for _, subject := range subjects {
+		tokenID, err := b.testGetter.TokenIDFromSubject(ctx, subject)
+		if err != nil {
+			errs[subject] = err
+			continue
+		}
+		tokenIDs[subject] = tokenID
+	}
+	return tokenIDs, errs
+}
+
+func TestFileTokenGetter(t *testing.T) {
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "tokens.csv")
+	require.NoError(t, os.WriteFile(csvFile, []byte("subject,token_id\ndevice1,1\n\"device2\", 2\n"), 0o600))
+	jsonFile := filepath.Join(dir, "tokens.json")
+	require.NoError(t, os.WriteFile(jsonFile, []byte(`{"device1": 1, "device2": 2}`), 0o600))
+
+	for _, path := range []string{csvFile, jsonFile} {
+		t.Run(filepath.Ext(path), func(t *testing.T) {
+			getter, err := newFileTokenGetter(path)
+			require.NoError(t, err)
+
+			tokenID, err := getter.TokenIDFromSubject(context.Background(), "device1")
+			require.NoError(t, err)
+			require.Equal(t, uint32(1), tokenID)
+			tokenID, err = getter.TokenIDFromSubject(context.Background(), "device2")
+			require.NoError(t, err)
+			require.Equal(t, uint32(2), tokenID)
+
+			_, err = getter.TokenIDFromSubject(context.Background(), "device3")
+			require.ErrorAs(t, err, &deviceapi.NotFoundError{})
+		})
+	}
+
+	badFile := filepath.Join(dir, "tokens.csv.bak")
+	require.NoError(t, os.WriteFile(badFile, []byte("device1,1\n"), 0o600))
+	_, err := newFileTokenGetter(badFile)
+	require.Error(t, err)
+
+	badCSV := filepath.Join(dir, "bad.csv")
+	require.NoError(t, os.WriteFile(badCSV, []byte("device1,1\ndevice2,two\n"), 0o600))
+	_, err = newFileTokenGetter(badCSV)
+	require.ErrorContains(t, err, "invalid token id on line 2")
+}
+
+func TestHTTPTokenGetter(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Method == http.MethodPost {
+			var req struct {
+				Query     string            `json:"query"`
+				Variables map[string]string `json:"variables"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			switch req.Variables["subject"] {
+			case "device1":
+				_, _ = w.Write([]byte(`{"data": {"device": {"tokenId": 1}}}`))
+			case errorSubject:
+				_, _ = w.Write([]byte(`{"data": null, "errors": [{"message": "boom"}]}`))
+			default:
+				_, _ = w.Write([]byte(`{"data": {"device": null}}`))
+			}
+			return
+		}
+		switch r.URL.Path {
+		case "/devices/device1":
+			_, _ = w.Write([]byte(`{"tokenId": "1"}`))
+		case "/devices/" + errorSubject:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	const restURL = "/devices/{subject}"
+	const query = "query($subject: String!) { device(id: $subject) { tokenId } }"
+	tests := []struct {
+		name        string
+		getter      *HTTPTokenGetter
+		subject     string
+		expectedID  uint32
+		expectedErr error
+		// expectedRequests is the number of requests made by two lookups.
+		expectedRequests int32
+	}{
+		{
+			name:             "rest",
+			getter:           NewHTTPTokenGetter(server.URL+restURL, "", "tokenId", server.Client(), time.Minute, time.Minute),
+			subject:          "device1",
+			expectedID:       1,
+			expectedRequests: 1,
+		},
+		{
+			name:             "rest without cache",
+			getter:           NewHTTPTokenGetter(server.URL+restURL, "", "tokenId", server.Client(), 0, 0),
+			subject:          "device1",
+			expectedID:       1,
+			expectedRequests: 2,
+		},
+		{
+			name:             "rest not found without cache",
+			getter:           NewHTTPTokenGetter(server.URL+restURL, "", "tokenId", server.Client(), time.Minute, 0),
+			subject:          notFoundSubject,
+			expectedErr:      deviceapi.NotFoundError{DeviceID: notFoundSubject},
+			expectedRequests: 2,
+		},
+		{
+			name:             "rest not found",
+			getter:           NewHTTPTokenGetter(server.URL+restURL, "", "tokenId", server.Client(), time.Minute, time.Minute),
+			subject:          notFoundSubject,
+			expectedErr:      deviceapi.NotFoundError{DeviceID: notFoundSubject},
+			expectedRequests: 1,
+		},
+		{
+			name:             "rest error",
+			getter:           NewHTTPTokenGetter(server.URL+restURL, "", "tokenId", server.Client(), time.Minute, time.Minute),
+			subject:          errorSubject,
+			expectedErr:      errors.New("unexpected status code 500"),
+			expectedRequests: 2,
+		},
+		{
+			name:             "graphql",
+			getter:           NewHTTPTokenGetter(server.URL, query, "data.device.tokenId", server.Client(), time.Minute, time.Minute),
+			subject:          "device1",
+			expectedID:       1,
+			expectedRequests: 1,
+		},
+		{
+			name:             "graphql not found",
+			getter:           NewHTTPTokenGetter(server.URL, query, "data.device.tokenId", server.Client(), time.Minute, time.Minute),
+			subject:          notFoundSubject,
+			expectedErr:      deviceapi.NotFoundError{DeviceID: notFoundSubject},
+			expectedRequests: 1,
+		},
+		{
+			name:             "graphql error",
+			getter:           NewHTTPTokenGetter(server.URL, query, "data.device.tokenId", server.Client(), time.Minute, time.Minute),
+			subject:          errorSubject,
+			expectedErr:      errors.New("graphql error: boom"),
+			expectedRequests: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Look up twice to exercise the cache.
+			requests.Store(0)
+			for range 2 {
+				tokenID, err := tt.getter.TokenIDFromSubject(context.Background(), tt.subject)
+				if tt.expectedErr != nil {
+					var notFound deviceapi.NotFoundError
+					if errors.As(tt.expectedErr, &notFound) {
+						require.ErrorAs(t, err, &notFound)
+					} else {
+						require.EqualError(t, err, tt.expectedErr.Error())
+					}
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, tt.expectedID, tokenID)
+			}
+			require.Equal(t, tt.expectedRequests, requests.Load())
+		})
+	}
+}
+
+func TestNewTokenIDGetter(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"device1": 1}`), 0o600))
+
+	tests := []struct {
+		name        string
+		config      string
+		expectedErr string
+	}{
+		{
+			name:   "file",
+			config: "token_source:\n  type: file\n  file:\n    path: " + tokenFile,
+		},
+		{
+			name:   "http",
+			config: "token_source:\n  type: http\n  http:\n    url: http://localhost/devices/{subject}",
+		},
+		{
+			name:   "devices api",
+			config: "devices_api_grpc_addr: localhost:3001",
+		},
+		{
+			name:        "devices api without address",
+			config:      "token_source:\n  type: devices_api",
+			expectedErr: "devices_api_grpc_addr must be set",
+		},
+		{
+			name:        "file without settings",
+			config:      "token_source:\n  type: file",
+			expectedErr: "the file field must be set",
+		},
+		{
+			name:        "http url without placeholder",
+			config:      "token_source:\n  type: http\n  http:\n    url: http://localhost/devices",
+			expectedErr: "url must contain the {subject} placeholder",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec().ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			getter, devicesConn, err := newTokenIDGetter(parsedConfig, nil)
+			if tt.expectedErr != "" {
+				require.ErrorContains(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, getter)
+			if devicesConn != nil {
+				require.NoError(t, devicesConn.Close())
+			}
+		})
+	}
+}
+
+// fakeUserDeviceServer returns token ID 7 for every device when called with the expected bearer token.
+type fakeUserDeviceServer struct {
+	pb.UnimplementedUserDeviceServiceServer
+	token string
+}
+
+func (f *fakeUserDeviceServer) GetUserDevice(ctx context.Context, req *pb.GetUserDeviceRequest) (*pb.UserDevice, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) != 1 || auth[0] != "Bearer "+f.token {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	tokenID := uint64(7)
+	return &pb.UserDevice{Id: req.GetId(), TokenId: &tokenID}, nil
+}
+
+// writeCert creates a certificate for dnsName signed by parent, or a self-signed CA when parent is nil,
+// and writes it and its key as PEM files to dir.
+func writeCert(t *testing.T, dir, name, dnsName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if dnsName != "" {
+		template.DNSNames = []string{dnsName}
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return cert, key
+}
+
+func TestDevicesAPITLS(t *testing.T) {
+	const serverName = "devices-api.internal"
+	const token = "secret-token"
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", "", nil, nil)
+	writeCert(t, dir, "server", serverName, ca, caKey)
+	writeCert(t, dir, "client", "", ca, caKey)
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	})))
+	pb.RegisterUserDeviceServiceServer(server, &fakeUserDeviceServer{token: token})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = server.Serve(lis) }()
+	defer server.Stop()
+
+	tlsConfig := fmt.Sprintf(`
+devices_api_grpc_addr: %s
+devices_api_tls:
+  enabled: true
+  root_cas_file: %s
+  client_certs:
+    - cert_file: %s
+      key_file: %s
+`, lis.Addr().String(), filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"))
+
+	tests := []struct {
+		name              string
+		config            string
+		expectedConfigErr string
+		expectedErr       bool
+	}{
+		{
+			name:   "tls with bearer token",
+			config: tlsConfig + "devices_api_server_name: " + serverName + "\ndevices_api_bearer_token: " + token,
+		},
+		{
+			name:        "wrong bearer token",
+			config:      tlsConfig + "devices_api_server_name: " + serverName + "\ndevices_api_bearer_token: wrong",
+			expectedErr: true,
+		},
+		{
+			name:        "server name mismatch",
+			config:      tlsConfig + "devices_api_bearer_token: " + token,
+			expectedErr: true,
+		},
+		{
+			name:              "bearer token without tls",
+			config:            "devices_api_grpc_addr: " + lis.Addr().String() + "\ndevices_api_bearer_token: " + token,
+			expectedConfigErr: "devices_api_bearer_token requires devices_api_tls to be enabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parsedConfig, err := configSpec().ParseYAML(tt.config, nil)
+			require.NoError(t, err)
+			getter, devicesConn, err := newTokenIDGetter(parsedConfig, nil)
+			if tt.expectedConfigErr != "" {
+				require.ErrorContains(t, err, tt.expectedConfigErr)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { require.NoError(t, devicesConn.Close()) }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			tokenID, err := getter.TokenIDFromSubject(ctx, "device1")
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, uint32(7), tokenID)
+		})
+	}
+}
+
+func TestCacheUpdateProcessor(t *testing.T) {
+	vssConfig, err := configSpec().ParseYAML(`
+devices_api_grpc_addr: localhost:0
+devices_api_retry:
+  max_retries: 0
+devices_api_cache:
+  name: lifecycle
+`, nil)
+	require.NoError(t, err)
+	vssProc, err := ctor(vssConfig, service.MockResources())
+	require.NoError(t, err)
+
+	updateConfig, err := cacheUpdateConfigSpec.ParseYAML(`
+cache: lifecycle
+subject: ${! json("subject") }
+token_id: ${! json("tokenId").or("") }
+`, nil)
+	require.NoError(t, err)
+	updateProc, err := cacheUpdateCtor(updateConfig, service.MockResources())
+	require.NoError(t, err)
+
+	var svc *deviceapi.Service
+	require.Equal(t, 1, tokenCaches.each("lifecycle", func(s *deviceapi.Service) { svc = s }))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name            string
+		event           string
+		expectedTokenID uint32
+		expectedErr     bool
+	}{
+		{
+			name:            "minted",
+			event:           `{"subject":"device1","tokenId":"9"}`,
+			expectedTokenID: 9,
+		},
+		{
+			name:            "transferred",
+			event:           `{"subject":"device1","tokenId":"10"}`,
+			expectedTokenID: 10,
+		},
+		{
+			// The devices API is unreachable, so an invalidated device can not be looked up.
+			name:        "burned",
+			event:       `{"subject":"device1"}`,
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := service.NewMessage([]byte(tt.event))
+			batch, err := updateProc.Process(ctx, msg)
+			require.NoError(t, err)
+			require.Equal(t, service.MessageBatch{msg}, batch)
+
+			tokenID, err := svc.TokenIDFromSubject(ctx, "device1")
+			if tt.expectedErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedTokenID, tokenID)
+		})
+	}
+
+	_, err = updateProc.Process(ctx, service.NewMessage([]byte(`{"subject":"device1","tokenId":"abc"}`)))
+	require.Error(t, err)
+
+	require.NoError(t, vssProc.Close(ctx))
+	require.Zero(t, tokenCaches.each("lifecycle", func(*deviceapi.Service) {}))
+	require.Equal(t, connectivity.Shutdown, vssProc.(*vssProcessor).devicesConn.GetState())
+	// Closing again does nothing.
+	require.NoError(t, vssProc.Close(ctx))
+}
+
+func TestCacheSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	config := fmt.Sprintf(`
+devices_api_grpc_addr: localhost:0
+devices_api_retry:
+  max_retries: 0
+devices_api_cache:
+  name: snapshots
+  snapshot:
+    path: %s
+`, path)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// newService creates a vss_vehicle processor and returns the devices API service it uses.
+	newService := func() (service.BatchProcessor, *deviceapi.Service) {
+		parsedConfig, err := configSpec().ParseYAML(config, nil)
+		require.NoError(t, err)
+		proc, err := ctor(parsedConfig, service.MockResources())
+		require.NoError(t, err)
+		var svc *deviceapi.Service
+		require.Equal(t, 1, tokenCaches.each("snapshots", func(s *deviceapi.Service) { svc = s }))
+		return proc, svc
+	}
+
+	proc, svc := newService()
+	svc.SetTokenID("device1", 9)
+	require.NoError(t, proc.Close(ctx))
+	require.FileExists(t, path)
+
+	// The restarted processor finds the token ID without the unreachable devices API.
+	proc, svc = newService()
+	defer func() { require.NoError(t, proc.Close(ctx)) }()
+	tokenID, err := svc.TokenIDFromSubject(ctx, "device1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(9), tokenID)
+	_, err = svc.TokenIDFromSubject(ctx, "device2")
+	require.Error(t, err)
+}
+
+func TestLimitedTokenGetter(t *testing.T) {
+	getter := NewLimitedTokenGetterWithConfig(&testGetter{}, nil, TokenStatsConfig{MaxDevices: 2, TTL: time.Hour})
+	// Every reading of the clock advances it by a millisecond, so every lookup takes a millisecond.
+	clock := time.Now()
+	getter.now = func() time.Time {
+		clock = clock.Add(time.Millisecond)
+		return clock
+	}
+	ctx := context.Background()
+
+	for _, subject := range []string{"1", notFoundSubject, notFoundSubject, errorSubject} {
+		_, _ = getter.TokenIDFromSubject(ctx, subject)
+	}
+	// The least recently looked up device is dropped to stay within two devices.
+	require.Equal(t, map[string]DeviceStats{
+		notFoundSubject: {NotFound: 2, Latency: 2 * time.Millisecond},
+		errorSubject:    {Errors: 1, Latency: time.Millisecond},
+	}, withoutTracking(getter.Stats()))
+
+	tokenIDs, errs := getter.TokenIDsFromSubjects(ctx, []string{"1", errorSubject})
+	require.Equal(t, map[string]uint32{"1": 1}, tokenIDs)
+	require.Len(t, errs, 1)
+	require.Equal(t, map[string]DeviceStats{
+		"1":          {Found: 1, Latency: time.Millisecond},
+		errorSubject: {Errors: 2, Latency: 2 * time.Millisecond},
+	}, withoutTracking(getter.Stats()))
+
+	// Devices that are not looked up within the ttl are dropped.
+	clock = clock.Add(time.Hour)
+	require.Empty(t, getter.Stats())
+}
+
+// withoutTracking clears the unexported tracking fields of stats so that they can be compared.
+func withoutTracking(stats map[string]DeviceStats) map[string]DeviceStats {
+	for userDeviceID, s := range stats {
+		stats[userDeviceID] = DeviceStats{Found: s.Found, NotFound: s.NotFound, Errors: s.Errors, Latency: s.Latency}
+	}
+	return stats
+}
+
+func TestVSSProcessorConvertedPolicy(t *testing.T) {
+	converted := `{"specversion":"1.0","dataschema":"dimo.zone.status/v1.1", "source": "source1", "time": "2024-12-23T12:34:00Z", "subject": "1", "data"{"speed": 1.0}}`
+	signalMsg := service.NewMessage(nil)
+	signalMsg.SetStructured(vss.SignalToSlice(vss.Signal{
+		TokenID:     1,
+		Timestamp:   time.UnixMilli(1734957240000).UTC(),
+		Name:        vss.FieldSpeed,
+		Source:      "source1",
+		ValueNumber: 1.0,
+	}))
+	signalBytes, err := signalMsg.AsBytes()
+	require.NoError(t, err)
+	tokenFile := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(`{"1": 1}`), 0o600))
+
+	tests := []struct {
+		policy        string
+		expectedBytes [][]byte
+		expectedErr   bool
+	}{
+		{policy: convertedPolicyDrop},
+		{policy: convertedPolicyPassthrough, expectedBytes: [][]byte{[]byte(converted)}},
+		{policy: convertedPolicyConvert, expectedBytes: [][]byte{signalBytes}},
+		{policy: convertedPolicyError, expectedErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			parsedConfig, err := configSpec().ParseYAML(fmt.Sprintf(`
+token_source:
+  type: file
+  file:
+    path: %s
+converted_payload_policy: %s
+`, tokenFile, tt.policy), nil)
+			require.NoError(t, err)
+			proc, err := ctor(parsedConfig, service.MockResources())
+			require.NoError(t, err)
+			defer func() { require.NoError(t, proc.Close(context.Background())) }()
+
+			batches, err := proc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte(converted))})
+			require.NoError(t, err)
+			if tt.expectedErr {
+				require.Len(t, batches, 1)
+				require.Len(t, batches[0], 1)
+				require.Error(t, batches[0][0].GetError())
+				return
+			}
+			var actualBytes [][]byte
+			for _, batch := range batches {
+				for _, msg := range batch {
+					require.NoError(t, msg.GetError())
+					msgBytes, err := msg.AsBytes()
+					require.NoError(t, err)
+					actualBytes = append(actualBytes, msgBytes)
+				}
+			}
+			require.Equal(t, tt.expectedBytes, actualBytes)
+		})
+	}
+}
+
+func TestVSSProcessorDeadLetter(t *testing.T) {
+	tests := []struct {
+		name           string
+		payload        string
+		expectedReason string
+		expectedMeta   map[string]string
+		expectedErr    bool
+	}{
+		{
+			name:           "token not found",
+			payload:        `{"specversion":"1.0", "source": "source1", "time": "2024-12-23T12:34:00Z", "subject": "not_found", "data"{"speed": 1.0}}`,
+			expectedReason: dropReasonTokenNotFound,
+			expectedMeta:   map[string]string{metaSubject: notFoundSubject, metaSchemaVersion: "v1.0.0"},
+		},
+		{
+			name:           "converted payload",
+			payload:        `{"specversion":"1.0","dataschema":"dimo.zone.status/v1.1", "source": "source1", "time": "2024-12-23T12:34:00Z", "subject": "1", "data"{"speed": 1.0}}`,
+			expectedReason: dropReasonConverted,
+			expectedMeta:   map[string]string{metaSubject: "1", metaSchemaVersion: "v1.1.0"},
+		},
+		{
+			name:           "conversion error",
+			payload:        `{"specversion":"1.0", "source": "source1", "time": "2024-12-23T12:34:00Z", "subject": "error", "data"{"speed": 1.0}}`,
+			expectedReason: dropReasonConversionError,
+			expectedMeta:   map[string]string{metaSubject: errorSubject, metaSchemaVersion: "v1.0.0"},
+			expectedErr:    true,
+		},
+		{
+			name:           "processing error",
+			payload:        `{"specversion":"1.0","dataschema":"dimo.zone.status/v3.0", "vehicleTokenId": 1, "source": "source1", "data": {"vehicle": {"signals": []}}}`,
+			expectedReason: dropReasonError,
+			expectedMeta:   map[string]string{metaSchemaVersion: "v3.0.0"},
+			expectedErr:    true,
+		},
+	}
+
+	vssProc := &vssProcessor{tokenGetter: &testGetter{}, deadLetter: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches, err := vssProc.ProcessBatch(context.Background(), service.MessageBatch{service.NewMessage([]byte(tt.payload))})
+			require.NoError(t, err)
+			require.Len(t, batches, 1)
+			require.Len(t, batches[0], 1)
+			msg := batches[0][0]
+
+			msgBytes, err := msg.AsBytes()
+			require.NoError(t, err)
+			require.Equal(t, tt.payload, string(msgBytes))
+			reason, ok := msg.MetaGet(metaDropReason)
+			require.True(t, ok)
+			require.Equal(t, tt.expectedReason, reason)
+			for key, expected := range tt.expectedMeta {
+				value, ok := msg.MetaGet(key)
+				require.True(t, ok, key)
+				require.Equal(t, expected, value, key)
+			}
+			_, hasSubject := msg.MetaGet(metaSubject)
+			require.Equal(t, tt.expectedMeta[metaSubject] != "", hasSubject)
+			_, hasDropErr := msg.MetaGet(metaDropError)
+			require.Equal(t, tt.expectedReason != dropReasonConverted, hasDropErr)
+			if tt.expectedErr {
+				require.Error(t, msg.GetError())
+			} else {
+				require.NoError(t, msg.GetError())
+			}
+		})
+	}
+}
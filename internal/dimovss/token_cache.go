@@ -0,0 +1,141 @@
+package dimovss
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/DIMO-Network/benthos-plugin/internal/service/deviceapi"
+	"github.com/redpanda-data/benthos/v4/public/service"
+)
+
+const (
+	cacheUpdatePluginName = "vss_token_cache"
+	cacheNameField        = "cache"
+	cacheSubjectField     = "subject"
+	cacheTokenIDField     = "token_id"
+	defaultCacheName      = "default"
+)
+
+var cacheUpdateConfigSpec = service.NewConfigSpec().
+	Summary("Updates the devices API token cache of `" + pluginName + "` processors from device lifecycle events.").
+	Description("Feed mint, burn and transfer events through this processor so that `" + pluginName + "` attributes signals " +
+		"to the right token immediately instead of when the cached token ID expires. Messages are passed through unchanged.").
+	Field(service.NewStringField(cacheNameField).
+		Description("The `" + grpcCacheFieldName + ".name` of the `" + pluginName + "` processors to update.").
+		Default(defaultCacheName)).
+	Field(service.NewInterpolatedStringField(cacheSubjectField).
+		Description("The userDevice subject of the event.").
+		Example(`${! json("subject") }`)).
+	Field(service.NewInterpolatedStringField(cacheTokenIDField).
+		Description("The token ID the subject now belongs to. If it is empty the cached token ID is dropped, " +
+			"so that the next message of the subject asks the devices API.").
+		Example(`${! json("tokenId").or("") }`).
+		Default(""))
+
+func init() {
+	err := service.RegisterProcessor(cacheUpdatePluginName, cacheUpdateConfigSpec, cacheUpdateCtor)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// tokenCaches holds the devices API services of the running vss_vehicle processors by cache name.
+var tokenCaches = &tokenCacheRegistry{services: map[string]map[*deviceapi.Service]struct{}{}}
+
+// tokenCacheRegistry lets vss_token_cache processors reach the caches of vss_vehicle processors.
+// The pipeline threads share a vss_vehicle processor, but several vss_vehicle processors can use the same
+// cache name, so a name can refer to several services.
+type tokenCacheRegistry struct {
+	mu       sync.RWMutex
+	services map[string]map[*deviceapi.Service]struct{}
+}
+
+// register adds svc under name until the returned function is called.
+func (r *tokenCacheRegistry) register(name string, svc *deviceapi.Service) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.services[name] == nil {
+		r.services[name] = map[*deviceapi.Service]struct{}{}
+	}
+	r.services[name][svc] = struct{}{}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.services[name], svc)
+		if len(r.services[name]) == 0 {
+			delete(r.services, name)
+		}
+	}
+}
+
+// each calls fn for every service registered under name and returns how many there were.
+func (r *tokenCacheRegistry) each(name string, fn func(*deviceapi.Service)) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for svc := range r.services[name] {
+		fn(svc)
+	}
+	return len(r.services[name])
+}
+
+type cacheUpdateProcessor struct {
+	logger  *service.Logger
+	name    string
+	subject *service.InterpolatedString
+	tokenID *service.InterpolatedString
+}
+
+func cacheUpdateCtor(cfg *service.ParsedConfig, mgr *service.Resources) (service.Processor, error) {
+	name, err := cfg.FieldString(cacheNameField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cache name: %w", err)
+	}
+	subject, err := cfg.FieldInterpolatedString(cacheSubjectField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subject: %w", err)
+	}
+	tokenID, err := cfg.FieldInterpolatedString(cacheTokenIDField)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token id: %w", err)
+	}
+	return &cacheUpdateProcessor{
+		logger:  mgr.Logger(),
+		name:    name,
+		subject: subject,
+		tokenID: tokenID,
+	}, nil
+}
+
+func (c *cacheUpdateProcessor) Process(_ context.Context, msg *service.Message) (service.MessageBatch, error) {
+	subject, err := c.subject.TryString(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate subject: %w", err)
+	}
+	if subject == "" {
+		return nil, fmt.Errorf("event has no subject")
+	}
+	tokenIDStr, err := c.tokenID.TryString(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate token id: %w", err)
+	}
+
+	update := func(svc *deviceapi.Service) { svc.Invalidate(subject) }
+	if tokenIDStr != "" {
+		tokenID, err := strconv.ParseUint(tokenIDStr, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse token id: %w", err)
+		}
+		update = func(svc *deviceapi.Service) { svc.SetTokenID(subject, uint32(tokenID)) }
+	}
+	if tokenCaches.each(c.name, update) == 0 {
+		c.logger.Debug(fmt.Sprintf("no %s processor uses cache '%s'", pluginName, c.name))
+	}
+	return service.MessageBatch{msg}, nil
+}
+
+// Close does nothing because our processor doesn't need to clean up resources.
+func (*cacheUpdateProcessor) Close(context.Context) error {
+	return nil
+}
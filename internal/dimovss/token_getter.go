@@ -1,51 +1,298 @@
 package dimovss
 
 import (
+	"container/list"
 	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/DIMO-Network/benthos-plugin/internal/service/deviceapi"
 	"github.com/DIMO-Network/model-garage/pkg/nativestatus"
 	"github.com/redpanda-data/benthos/v4/public/service"
-	"golang.org/x/time/rate"
 )
 
+const (
+	tokenStatsFieldName = "token_lookup_stats"
+	// foundLogInterval is how often a found token id is logged per userDevice.
+	foundLogInterval = 24 * time.Hour
+)
+
+var tokenStatsField = service.NewObjectField(tokenStatsFieldName,
+	service.NewIntField("max_devices").
+		Description("Maximum number of userDevices whose lookup outcomes are tracked. The least recently looked up is dropped first. Zero is unbounded.").
+		Default(DefaultTokenStatsConfig().MaxDevices),
+	service.NewDurationField("ttl").
+		Description("How long a userDevice that is not looked up again is tracked.").
+		Default(DefaultTokenStatsConfig().TTL.String()),
+	service.NewDurationField("summary_interval").
+		Description("How often a summary of the lookup outcomes is logged. Zero disables the summary.").
+		Default("1h"),
+	service.NewIntField("summary_top").
+		Description("Number of userDevices with the most failed lookups listed in the summary.").
+		Default(10),
+).Description("Tracking of the token ID lookup outcomes (found, not found, error and latency) per userDevice.").Advanced()
+
+// BatchTokenIDGetter resolves the token IDs of many subjects with one lookup.
+type BatchTokenIDGetter interface {
+	// TokenIDsFromSubjects returns the token IDs of subjects. A subject that could not be resolved is missing
+	// from tokenIDs and has its error in errs.
+	TokenIDsFromSubjects(ctx context.Context, subjects []string) (tokenIDs map[string]uint32, errs map[string]error)
+}
+
+// TokenStatsConfig bounds the per userDevice lookup stats kept by a LimitedTokenGetter.
+type TokenStatsConfig struct {
+	// MaxDevices is the number of userDevices tracked, the least recently looked up is dropped first. Zero is unbounded.
+	MaxDevices int
+	// TTL is how long a userDevice that is not looked up again is tracked. Zero tracks it until it is dropped for MaxDevices.
+	TTL time.Duration
+}
+
+// tokenStatsConfig reads the lookup stats settings from the processor config.
+func tokenStatsConfig(cfg *service.ParsedConfig) (TokenStatsConfig, error) {
+	var config TokenStatsConfig
+	var err error
+	if config.MaxDevices, err = cfg.FieldInt(tokenStatsFieldName, "max_devices"); err != nil {
+		return config, fmt.Errorf("failed to get max devices: %w", err)
+	}
+	if config.TTL, err = cfg.FieldDuration(tokenStatsFieldName, "ttl"); err != nil {
+		return config, fmt.Errorf("failed to get stats ttl: %w", err)
+	}
+	return config, nil
+}
+
+// statsSummaries are the settings of the periodic lookup stats summary.
+type statsSummaries struct {
+	interval time.Duration
+	top      int
+}
+
+// statsSummariesConfig reads the summary settings from the processor config.
+func statsSummariesConfig(cfg *service.ParsedConfig) (statsSummaries, error) {
+	var conf statsSummaries
+	var err error
+	if conf.interval, err = cfg.FieldDuration(tokenStatsFieldName, "summary_interval"); err != nil {
+		return conf, fmt.Errorf("failed to get summary interval: %w", err)
+	}
+	if conf.top, err = cfg.FieldInt(tokenStatsFieldName, "summary_top"); err != nil {
+		return conf, fmt.Errorf("failed to get summary top: %w", err)
+	}
+	return conf, nil
+}
+
+// startStatsSummaries logs a summary of the lookup stats of getter at the configured interval.
+// The returned function stops logging after a final summary.
+func startStatsSummaries(conf statsSummaries, getter *LimitedTokenGetter) func() {
+	if conf.interval <= 0 {
+		return func() {}
+	}
+	return runPeriodically(conf.interval, func() { getter.LogSummary(conf.top) })
+}
+
+// DefaultTokenStatsConfig returns the TokenStatsConfig used by NewLimitedTokenGetter.
+func DefaultTokenStatsConfig() TokenStatsConfig {
+	return TokenStatsConfig{
+		MaxDevices: 100_000,
+		TTL:        foundLogInterval,
+	}
+}
+
+// DeviceStats are the lookup outcomes of a userDevice.
+type DeviceStats struct {
+	Found    int
+	NotFound int
+	Errors   int
+	// Latency is the total duration of the lookups.
+	Latency time.Duration
+
+	userDeviceID string
+	lastSeen     time.Time
+	lastLogged   time.Time
+}
+
+// Lookups returns the number of lookups.
+func (d DeviceStats) Lookups() int {
+	return d.Found + d.NotFound + d.Errors
+}
+
+// add counts the outcome of a lookup.
+func (d *DeviceStats) add(err error, latency time.Duration) {
+	d.Latency += latency
+	switch {
+	case err == nil:
+		d.Found++
+	case errors.As(err, &deviceapi.NotFoundError{}):
+		d.NotFound++
+	default:
+		d.Errors++
+	}
+}
+
+// LimitedTokenGetter wraps a TokenIDGetter, records the lookup outcomes of every userDevice
+// and logs a found token id once per day per userDevice.
 type LimitedTokenGetter struct {
 	tokenGetter nativestatus.TokenIDGetter
-	limiters    map[string]*rate.Sometimes
-	mapMutex    sync.RWMutex
 	logger      *service.Logger
+	config      TokenStatsConfig
+	mapMutex    sync.Mutex
+	devices     map[string]*list.Element
+	// order holds the DeviceStats from most to least recently looked up.
+	order *list.List
+	// window sums the outcomes since the last summary.
+	window DeviceStats
+	now    func() time.Time
 }
 
 func NewLimitedTokenGetter(tokenGetter nativestatus.TokenIDGetter, logger *service.Logger) *LimitedTokenGetter {
+	return NewLimitedTokenGetterWithConfig(tokenGetter, logger, DefaultTokenStatsConfig())
+}
+
+// NewLimitedTokenGetterWithConfig is NewLimitedTokenGetter with control over the tracked userDevices.
+func NewLimitedTokenGetterWithConfig(tokenGetter nativestatus.TokenIDGetter, logger *service.Logger, config TokenStatsConfig) *LimitedTokenGetter {
 	return &LimitedTokenGetter{
 		tokenGetter: tokenGetter,
-		limiters:    map[string]*rate.Sometimes{},
 		logger:      logger,
+		config:      config,
+		devices:     map[string]*list.Element{},
+		order:       list.New(),
+		now:         time.Now,
 	}
 }
 
 // TokenIDFromSubject wraps a provided TokenIDGetter and logs successful queries once per day per userDevice.
 func (l *LimitedTokenGetter) TokenIDFromSubject(ctx context.Context, userDeviceID string) (uint32, error) {
+	start := l.now()
 	tokenID, err := l.tokenGetter.TokenIDFromSubject(ctx, userDeviceID)
+	l.record(userDeviceID, tokenID, err, l.now().Sub(start))
 	if err != nil {
 		return 0, err
 	}
-	l.mapMutex.RLock()
-	limiter, ok := l.limiters[userDeviceID]
-	l.mapMutex.RUnlock()
+	return tokenID, nil
+}
+
+// TokenIDsFromSubjects resolves the subjects with one lookup if the wrapped TokenIDGetter supports it,
+// and one by one otherwise.
+func (l *LimitedTokenGetter) TokenIDsFromSubjects(ctx context.Context, userDeviceIDs []string) (map[string]uint32, map[string]error) {
+	batchGetter, ok := l.tokenGetter.(BatchTokenIDGetter)
 	if !ok {
-		// limit to one log per day.
-		limiter = &rate.Sometimes{
-			Interval: time.Hour * 24,
-			First:    1,
+		tokenIDs := make(map[string]uint32, len(userDeviceIDs))
+		errs := map[string]error{}
+		for _, userDeviceID := range userDeviceIDs {
+			tokenID, err := l.TokenIDFromSubject(ctx, userDeviceID)
+			if err != nil {
+				errs[userDeviceID] = err
+				continue
+			}
+			tokenIDs[userDeviceID] = tokenID
+		}
+		return tokenIDs, errs
+	}
+
+	start := l.now()
+	tokenIDs, errs := batchGetter.TokenIDsFromSubjects(ctx, userDeviceIDs)
+	// Every subject waited for the whole bulk lookup.
+	latency := l.now().Sub(start)
+	for userDeviceID, tokenID := range tokenIDs {
+		l.record(userDeviceID, tokenID, nil, latency)
+	}
+	for userDeviceID, err := range errs {
+		l.record(userDeviceID, 0, err, latency)
+	}
+	return tokenIDs, errs
+}
+
+// record adds the outcome of a lookup to the stats of userDeviceID and logs a found token id once per day.
+func (l *LimitedTokenGetter) record(userDeviceID string, tokenID uint32, err error, latency time.Duration) {
+	l.mapMutex.Lock()
+	defer l.mapMutex.Unlock()
+	now := l.now()
+	l.expire(now)
+
+	elem, ok := l.devices[userDeviceID]
+	if ok {
+		l.order.MoveToFront(elem)
+	} else {
+		elem = l.order.PushFront(&DeviceStats{userDeviceID: userDeviceID})
+		l.devices[userDeviceID] = elem
+		if l.config.MaxDevices > 0 && l.order.Len() > l.config.MaxDevices {
+			l.remove(l.order.Back())
 		}
-		l.mapMutex.Lock()
-		l.limiters[userDeviceID] = limiter
-		l.mapMutex.Unlock()
 	}
-	limiter.Do(func() {
+	stats := elem.Value.(*DeviceStats)
+	stats.lastSeen = now
+	stats.add(err, latency)
+	l.window.add(err, latency)
+
+	if err == nil && now.Sub(stats.lastLogged) >= foundLogInterval {
+		stats.lastLogged = now
 		l.logger.Infof("Found token id '%d' for userDevice '%s'", tokenID, userDeviceID)
+	}
+}
+
+// expire drops the userDevices that were not looked up within the TTL.
+func (l *LimitedTokenGetter) expire(now time.Time) {
+	if l.config.TTL <= 0 {
+		return
+	}
+	for elem := l.order.Back(); elem != nil; elem = l.order.Back() {
+		if now.Sub(elem.Value.(*DeviceStats).lastSeen) < l.config.TTL {
+			return
+		}
+		l.remove(elem)
+	}
+}
+
+func (l *LimitedTokenGetter) remove(elem *list.Element) {
+	l.order.Remove(elem)
+	delete(l.devices, elem.Value.(*DeviceStats).userDeviceID)
+}
+
+// Stats returns the lookup outcomes of the tracked userDevices.
+func (l *LimitedTokenGetter) Stats() map[string]DeviceStats {
+	l.mapMutex.Lock()
+	defer l.mapMutex.Unlock()
+	l.expire(l.now())
+	stats := make(map[string]DeviceStats, len(l.devices))
+	for userDeviceID, elem := range l.devices {
+		stats[userDeviceID] = *elem.Value.(*DeviceStats)
+	}
+	return stats
+}
+
+// LogSummary logs the lookup outcomes since the last summary and the tracked userDevices with the most failed lookups.
+func (l *LimitedTokenGetter) LogSummary(topFailed int) {
+	l.mapMutex.Lock()
+	l.expire(l.now())
+	window := l.window
+	l.window = DeviceStats{}
+	tracked := len(l.devices)
+	var failed []DeviceStats
+	for _, elem := range l.devices {
+		if stats := elem.Value.(*DeviceStats); stats.NotFound+stats.Errors > 0 {
+			failed = append(failed, *stats)
+		}
+	}
+	l.mapMutex.Unlock()
+
+	var avgLatency time.Duration
+	if lookups := window.Lookups(); lookups > 0 {
+		avgLatency = window.Latency / time.Duration(lookups)
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		if fi, fj := failed[i].NotFound+failed[i].Errors, failed[j].NotFound+failed[j].Errors; fi != fj {
+			return fi > fj
+		}
+		return failed[i].userDeviceID < failed[j].userDeviceID
 	})
-	return tokenID, nil
+	failed = failed[:min(max(topFailed, 0), len(failed))]
+	top := make([]string, 0, len(failed))
+	for _, stats := range failed {
+		top = append(top, fmt.Sprintf("%s (%d not found, %d errors)", stats.userDeviceID, stats.NotFound, stats.Errors))
+	}
+	l.logger.Infof("Token lookups since last summary: %d found, %d not found, %d errors, average latency %s. "+
+		"Tracking %d userDevices, most failed: [%s]",
+		window.Found, window.NotFound, window.Errors, avgLatency, tracked, strings.Join(top, ", "))
 }
@@ -0,0 +1,394 @@
+package dimovss
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/benthos-plugin/internal/service/deviceapi"
+	"github.com/DIMO-Network/model-garage/pkg/nativestatus"
+	gocache "github.com/patrickmn/go-cache"
+	"github.com/redpanda-data/benthos/v4/public/service"
+	"google.golang.org/grpc"
+)
+
+const (
+	tokenSourceFieldName = "token_source"
+	tokenSourceTypeField = "type"
+	tokenSourceFileField = "file"
+	tokenSourceHTTPField = "http"
+	subjectPlaceholder   = "{subject}"
+)
+
+// Token source types.
+const (
+	tokenSourceDevicesAPI = "devices_api"
+	tokenSourceFile       = "file"
+	tokenSourceHTTP       = "http"
+)
+
+var tokenSourceField = service.NewObjectField(tokenSourceFieldName,
+	service.NewStringAnnotatedEnumField(tokenSourceTypeField, map[string]string{
+		tokenSourceDevicesAPI: "Look up token IDs with the devices API gRPC server at `" + grpcFieldName + "`.",
+		tokenSourceFile:       "Look up token IDs in a static mapping file, useful for offline replays and local testing.",
+		tokenSourceHTTP:       "Look up token IDs with an HTTP or GraphQL identity service.",
+	}).Description("Backend used to resolve the token ID of a device.").Default(tokenSourceDevicesAPI),
+	service.NewObjectField(tokenSourceFileField,
+		service.NewStringField("path").
+			Description("Path to a CSV file of `subject,token_id` rows or a JSON object mapping subjects to token IDs. "+
+				"The format is chosen by the file extension.").
+			Example("./tokens.csv"),
+	).Description("Settings of the `"+tokenSourceFile+"` token source.").Optional(),
+	service.NewObjectField(tokenSourceHTTPField,
+		service.NewStringField("url").
+			Description("URL of the identity service. Without a `query`, a GET request is sent with `"+subjectPlaceholder+"` replaced by the subject.").
+			Example("http://identity-api/v1/devices/"+subjectPlaceholder),
+		service.NewStringField("query").
+			Description("GraphQL query to POST to the url. The subject is passed as the `subject` variable.").
+			Example(`query($subject: String!) { device(id: $subject) { tokenId } }`).
+			Default(""),
+		service.NewStringField("token_id_path").
+			Description("Dot separated path of the token ID in the JSON response.").
+			Example("data.device.tokenId").
+			Default("tokenId"),
+		service.NewDurationField("timeout").
+			Description("Maximum time to wait for a response.").
+			Default("5s"),
+		service.NewDurationField("cache_ttl").
+			Description("How long resolved token IDs are cached. Zero disables the cache.").
+			Default("24h"),
+		service.NewDurationField("not_found_ttl").
+			Description("How long it is cached that a subject has no token ID, so that devices that are not minted yet "+
+				"are not looked up for every message. Zero disables caching them.").
+			Default("5m"),
+	).Description("Settings of the `"+tokenSourceHTTP+"` token source.").Optional(),
+).Description("Where token IDs of devices are looked up. Defaults to the devices API.").Optional()
+
+// newTokenIDGetter creates the TokenIDGetter described by the processor config.
+// The devices API connection is returned so that it can be closed, it is nil for the other token sources.
+func newTokenIDGetter(cfg *service.ParsedConfig, metrics *service.Metrics) (nativestatus.TokenIDGetter, *grpc.ClientConn, error) {
+	sourceType := tokenSourceDevicesAPI
+	var sourceConf *service.ParsedConfig
+	if cfg.Contains(tokenSourceFieldName) {
+		sourceConf = cfg.Namespace(tokenSourceFieldName)
+		var err error
+		sourceType, err = sourceConf.FieldString(tokenSourceTypeField)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get token source type: %w", err)
+		}
+	}
+
+	switch sourceType {
+	case tokenSourceFile:
+		if !sourceConf.Contains(tokenSourceFileField) {
+			return nil, nil, fmt.Errorf("the %s field must be set for the %s token source", tokenSourceFileField, tokenSourceFile)
+		}
+		path, err := sourceConf.FieldString(tokenSourceFileField, "path")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get token file path: %w", err)
+		}
+		getter, err := newFileTokenGetter(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		return getter, nil, nil
+	case tokenSourceHTTP:
+		if !sourceConf.Contains(tokenSourceHTTPField) {
+			return nil, nil, fmt.Errorf("the %s field must be set for the %s token source", tokenSourceHTTPField, tokenSourceHTTP)
+		}
+		getter, err := newHTTPTokenGetterFromConfig(sourceConf.Namespace(tokenSourceHTTPField))
+		if err != nil {
+			return nil, nil, err
+		}
+		return getter, nil, nil
+	default:
+		if !cfg.Contains(grpcFieldName) {
+			return nil, nil, fmt.Errorf("%s must be set for the %s token source", grpcFieldName, tokenSourceDevicesAPI)
+		}
+		config, err := devicesAPIConfig(cfg, metrics)
+		if err != nil {
+			return nil, nil, err
+		}
+		devicesConn, err := dialDevicesAPI(cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return deviceapi.NewServiceWithConfig(devicesConn, config), devicesConn, nil
+	}
+}
+
+// FileTokenGetter resolves token IDs from a static mapping.
+type FileTokenGetter struct {
+	tokenIDs map[string]uint32
+}
+
+// newFileTokenGetter loads a CSV or JSON mapping of subjects to token IDs.
+func newFileTokenGetter(path string) (*FileTokenGetter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	var tokenIDs map[string]uint32
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".csv":
+		tokenIDs, err = parseTokenCSV(data)
+	case ".json":
+		err = json.Unmarshal(data, &tokenIDs)
+	default:
+		return nil, fmt.Errorf("unsupported token file extension '%s', expected .csv or .json", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token file: %w", err)
+	}
+	return &FileTokenGetter{tokenIDs: tokenIDs}, nil
+}
+
+// parseTokenCSV parses subject,token_id rows. A first row whose token ID is not a number is treated as a header.
+func parseTokenCSV(data []byte) (map[string]uint32, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	tokenIDs := map[string]uint32{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return tokenIDs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		tokenID, err := strconv.ParseUint(record[1], 10, 32)
+		if err != nil {
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("invalid token id on line %d: %w", line, err)
+		}
+		tokenIDs[record[0]] = uint32(tokenID)
+	}
+}
+
+// TokenIDFromSubject returns the token ID listed for subject.
+func (f *FileTokenGetter) TokenIDFromSubject(_ context.Context, subject string) (uint32, error) {
+	tokenID, ok := f.tokenIDs[subject]
+	if !ok {
+		return 0, fmt.Errorf("%w: not in token file", deviceapi.NotFoundError{DeviceID: subject})
+	}
+	return tokenID, nil
+}
+
+// HTTPTokenGetter resolves token IDs with a REST or GraphQL identity service.
+type HTTPTokenGetter struct {
+	url         string
+	query       string
+	tokenIDPath []string
+	client      *http.Client
+	cacheTTL    time.Duration
+	notFoundTTL time.Duration
+	// cache holds token IDs and NotFoundErrors, it is nil when both TTLs are zero.
+	cache *gocache.Cache
+}
+
+func newHTTPTokenGetterFromConfig(conf *service.ParsedConfig) (*HTTPTokenGetter, error) {
+	rawURL, err := conf.FieldString("url")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get url: %w", err)
+	}
+	query, err := conf.FieldString("query")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get query: %w", err)
+	}
+	if query == "" && !strings.Contains(rawURL, subjectPlaceholder) {
+		return nil, fmt.Errorf("url must contain the %s placeholder when no query is set", subjectPlaceholder)
+	}
+	tokenIDPath, err := conf.FieldString("token_id_path")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token id path: %w", err)
+	}
+	timeout, err := conf.FieldDuration("timeout")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timeout: %w", err)
+	}
+	cacheTTL, err := conf.FieldDuration("cache_ttl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cache ttl: %w", err)
+	}
+	notFoundTTL, err := conf.FieldDuration("not_found_ttl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get not found ttl: %w", err)
+	}
+	return NewHTTPTokenGetter(rawURL, query, tokenIDPath, &http.Client{Timeout: timeout}, cacheTTL, notFoundTTL), nil
+}
+
+// NewHTTPTokenGetter creates an HTTPTokenGetter. If query is empty, subjects are looked up with a GET request
+// to rawURL with the {subject} placeholder replaced, otherwise query is sent to rawURL as a GraphQL request.
+// Token IDs are cached for cacheTTL and subjects without one for notFoundTTL, a zero TTL disables that cache.
+func NewHTTPTokenGetter(rawURL, query, tokenIDPath string, client *http.Client, cacheTTL, notFoundTTL time.Duration) *HTTPTokenGetter {
+	getter := &HTTPTokenGetter{
+		url:         rawURL,
+		query:       query,
+		tokenIDPath: strings.Split(tokenIDPath, "."),
+		client:      client,
+		cacheTTL:    cacheTTL,
+		notFoundTTL: notFoundTTL,
+	}
+	if ttl := max(cacheTTL, notFoundTTL); ttl > 0 {
+		getter.cache = gocache.New(ttl, 2*ttl)
+	}
+	return getter
+}
+
+type graphQLRequest struct {
+	Query     string         `json:"query"`
+	Variables map[string]any `json:"variables"`
+}
+
+// TokenIDFromSubject returns the cached token ID of subject, requesting it when it is not cached.
+func (h *HTTPTokenGetter) TokenIDFromSubject(ctx context.Context, subject string) (uint32, error) {
+	if h.cache != nil {
+		if cached, found := h.cache.Get(subject); found {
+			if err, ok := cached.(error); ok {
+				return 0, err
+			}
+			return cached.(uint32), nil
+		}
+	}
+
+	tokenID, err := h.requestTokenID(ctx, subject)
+	if errors.As(err, &deviceapi.NotFoundError{}) {
+		h.cacheResult(subject, err, h.notFoundTTL)
+		return 0, err
+	}
+	if err != nil {
+		return 0, err
+	}
+	h.cacheResult(subject, tokenID, h.cacheTTL)
+	return tokenID, nil
+}
+
+// cacheResult caches the token ID or NotFoundError of subject for ttl, if that is positive.
+func (h *HTTPTokenGetter) cacheResult(subject string, result any, ttl time.Duration) {
+	if h.cache != nil && ttl > 0 {
+		h.cache.Set(subject, result, ttl)
+	}
+}
+
+// requestTokenID requests the token ID of subject from the configured URL.
+func (h *HTTPTokenGetter) requestTokenID(ctx context.Context, subject string) (uint32, error) {
+	req, err := h.newRequest(ctx, subject)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, fmt.Errorf("%w: identity service returned not found", deviceapi.NotFoundError{DeviceID: subject})
+	default:
+		return 0, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	decoder.UseNumber()
+	var body map[string]any
+	if err := decoder.Decode(&body); err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if h.query != "" {
+		if err := graphQLErrors(body); err != nil {
+			return 0, err
+		}
+	}
+
+	tokenID, err := h.tokenIDFromBody(body)
+	if errors.Is(err, errNoTokenID) {
+		return 0, fmt.Errorf("%w: %w", deviceapi.NotFoundError{DeviceID: subject}, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return tokenID, nil
+}
+
+func (h *HTTPTokenGetter) newRequest(ctx context.Context, subject string) (*http.Request, error) {
+	if h.query == "" {
+		reqURL := strings.ReplaceAll(h.url, subjectPlaceholder, url.PathEscape(subject))
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %w", err)
+		}
+		return req, nil
+	}
+
+	body, err := json.Marshal(graphQLRequest{Query: h.query, Variables: map[string]any{"subject": subject}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode query: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// graphQLErrors returns the errors listed in a GraphQL response, if any.
+func graphQLErrors(body map[string]any) error {
+	rawErrs, ok := body["errors"].([]any)
+	if !ok || len(rawErrs) == 0 {
+		return nil
+	}
+	errs := make([]error, 0, len(rawErrs))
+	for _, rawErr := range rawErrs {
+		if errObj, ok := rawErr.(map[string]any); ok {
+			errs = append(errs, fmt.Errorf("graphql error: %v", errObj["message"]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// errNoTokenID is returned when the response has no token ID, which identity services use for unknown devices.
+var errNoTokenID = errors.New("no token id in response")
+
+// tokenIDFromBody follows the token ID path through the decoded response.
+func (h *HTTPTokenGetter) tokenIDFromBody(body map[string]any) (uint32, error) {
+	var value any = body
+	for _, key := range h.tokenIDPath {
+		obj, ok := value.(map[string]any)
+		if !ok {
+			return 0, errNoTokenID
+		}
+		value = obj[key]
+	}
+
+	var raw string
+	switch v := value.(type) {
+	case json.Number:
+		raw = v.String()
+	case string:
+		raw = v
+	default:
+		return 0, errNoTokenID
+	}
+	tokenID, err := strconv.ParseUint(raw, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid token id: %w", err)
+	}
+	return uint32(tokenID), nil
+}
@@ -0,0 +1,115 @@
+package deviceapi
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// tokenCacheEntry is a cached lookup result. A negative entry remembers a device without a tokenID.
+type tokenCacheEntry struct {
+	id       string
+	tokenID  uint32
+	negative bool
+	expires  time.Time
+}
+
+// tokenCache is a least recently used cache of token IDs with per entry expiry.
+type tokenCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// order holds the entries from most to least recently used.
+	order   *list.List
+	onEvict func()
+	now     func() time.Time
+}
+
+// newTokenCache creates a cache holding at most size entries, or any number of entries if size is not positive.
+// onEvict, if set, is called for every entry evicted to stay within size.
+func newTokenCache(size int, onEvict func()) *tokenCache {
+	return &tokenCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		onEvict: onEvict,
+		now:     time.Now,
+	}
+}
+
+// get returns the unexpired entry of id.
+func (c *tokenCache) get(id string) (tokenCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[id]
+	if !ok {
+		return tokenCacheEntry{}, false
+	}
+	entry := elem.Value.(tokenCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+		return tokenCacheEntry{}, false
+	}
+	c.order.MoveToFront(elem)
+	return entry, true
+}
+
+// set stores the result of id for ttl, evicting the least recently used entry if the cache is full.
+// Nothing is stored for a non-positive ttl.
+func (c *tokenCache) set(id string, tokenID uint32, negative bool, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	entry := tokenCacheEntry{id: id, tokenID: tokenID, negative: negative}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry.expires = c.now().Add(ttl)
+	if elem, ok := c.entries[id]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[id] = c.order.PushFront(entry)
+	if c.size <= 0 || c.order.Len() <= c.size {
+		return
+	}
+	oldest := c.order.Back()
+	c.order.Remove(oldest)
+	delete(c.entries, oldest.Value.(tokenCacheEntry).id)
+	if c.onEvict != nil {
+		c.onEvict()
+	}
+}
+
+// remove drops the entry of id.
+func (c *tokenCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[id]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, id)
+	}
+}
+
+// snapshot returns the unexpired entries of found tokenIDs from most to least recently used.
+func (c *tokenCache) snapshot() []tokenCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	entries := make([]tokenCacheEntry, 0, c.order.Len())
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(tokenCacheEntry)
+		if !entry.negative && now.Before(entry.expires) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// len returns the number of entries, including expired entries that have not been removed yet.
+func (c *tokenCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -4,20 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	pb "github.com/DIMO-Network/devices-api/pkg/grpc"
-	gocache "github.com/patrickmn/go-cache"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-const (
-	deviceTokenCacheKey = "udID_%s"
-	cacheDefaultExp     = 24 * time.Hour
-)
-
 // NotFoundError is an error type for when a device's token is not found.
 type NotFoundError struct {
 	DeviceID string
@@ -28,43 +25,271 @@ func (e NotFoundError) Error() string {
 	return fmt.Sprintf("device token not found for userDevice '%s'", e.DeviceID)
 }
 
+// Config controls how a Service calls the devices API.
+type Config struct {
+	// Timeout bounds each GetUserDevice call. Zero only applies the deadline of the caller's context.
+	Timeout time.Duration
+	// MaxRetries is how many times a call that failed with a retryable code is retried.
+	MaxRetries int
+	// InitialBackoff is the wait before the first retry, it doubles for every further retry up to MaxBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries.
+	MaxBackoff time.Duration
+	// BreakerThreshold is the number of consecutive failed lookups that opens the circuit breaker. Zero disables it.
+	BreakerThreshold int
+	// BreakerCooldown is how long the circuit breaker stays open before a trial call is let through.
+	BreakerCooldown time.Duration
+	// CacheTTL is how long a found tokenID is cached. Zero disables caching.
+	CacheTTL time.Duration
+	// CacheSize bounds the number of cached devices, evicting the least recently used. Zero leaves the cache unbounded.
+	CacheSize int
+	// OnEvict, if set, is called for every device evicted to stay within CacheSize.
+	OnEvict func()
+	// NotFoundTTL is how long a device that does not exist or has no tokenID is remembered. Zero disables negative caching.
+	NotFoundTTL time.Duration
+	// LookupConcurrency bounds the concurrent calls of TokenIDsFromSubjects. Zero leaves it unbounded.
+	LookupConcurrency int
+}
+
+// DefaultConfig returns the Config used by NewService.
+func DefaultConfig() Config {
+	return Config{
+		Timeout:           5 * time.Second,
+		MaxRetries:        3,
+		InitialBackoff:    100 * time.Millisecond,
+		MaxBackoff:        2 * time.Second,
+		BreakerThreshold:  5,
+		BreakerCooldown:   30 * time.Second,
+		CacheTTL:          24 * time.Hour,
+		CacheSize:         1_000_000,
+		NotFoundTTL:       5 * time.Minute,
+		LookupConcurrency: 16,
+	}
+}
+
 // Service is a wrapper for a the device-api grpc client
 type Service struct {
 	devicesConn *grpc.ClientConn
-	memoryCache *gocache.Cache
+	memoryCache *tokenCache
+	config      Config
+	breaker     *circuitBreaker
+	lookups     singleflight.Group
+	// mu guards generations and orders lookup results against SetTokenID and Invalidate.
+	mu          sync.Mutex
+	generations map[string]*lookupGeneration
+}
+
+// lookupGeneration counts the cache updates of an id while devices API calls for it are in flight.
+type lookupGeneration struct {
+	value   uint64
+	lookups int
 }
 
 // NewService API wrapper to call device-telemetry-api to get the userDevices associated with a userId over grpc
 func NewService(devicesConn *grpc.ClientConn) *Service {
-	c := gocache.New(cacheDefaultExp, 15*time.Minute)
-	return &Service{devicesConn: devicesConn, memoryCache: c}
+	return NewServiceWithConfig(devicesConn, DefaultConfig())
+}
+
+// NewServiceWithConfig is NewService with control over timeouts, retries, circuit breaking and caching.
+func NewServiceWithConfig(devicesConn *grpc.ClientConn, config Config) *Service {
+	return &Service{
+		devicesConn: devicesConn,
+		memoryCache: newTokenCache(config.CacheSize, config.OnEvict),
+		config:      config,
+		breaker:     newCircuitBreaker(config.BreakerThreshold, config.BreakerCooldown),
+		generations: map[string]*lookupGeneration{},
+	}
 }
 
 // TokenIDFromSubject gets the tokenID from a userDevice subject
 func (s *Service) TokenIDFromSubject(ctx context.Context, id string) (uint32, error) {
-	deviceClient := pb.NewUserDeviceServiceClient(s.devicesConn)
-	var err error
-	var userDevice *pb.UserDevice
-
-	get, found := s.memoryCache.Get(fmt.Sprintf(deviceTokenCacheKey, id))
-	if found {
-		userDevice = get.(*pb.UserDevice)
-	} else {
-		userDevice, err = deviceClient.GetUserDevice(ctx, &pb.GetUserDeviceRequest{
-			Id: id,
+	if tokenID, found, err := s.cachedTokenID(id); found {
+		return tokenID, err
+	}
+	return s.lookupTokenID(ctx, id)
+}
+
+// TokenIDsFromSubjects gets the tokenIDs of many userDevice subjects. A subject that could not be resolved is
+// missing from tokenIDs and has its error in errs. The devices API has no bulk lookup, so uncached subjects are
+// looked up concurrently, at most LookupConcurrency at a time.
+func (s *Service) TokenIDsFromSubjects(ctx context.Context, ids []string) (tokenIDs map[string]uint32, errs map[string]error) {
+	tokenIDs = make(map[string]uint32, len(ids))
+	errs = map[string]error{}
+	var misses []string
+	for _, id := range ids {
+		tokenID, found, err := s.cachedTokenID(id)
+		switch {
+		case !found:
+			misses = append(misses, id)
+		case err != nil:
+			errs[id] = err
+		default:
+			tokenIDs[id] = tokenID
+		}
+	}
+
+	var mu sync.Mutex
+	var group errgroup.Group
+	if s.config.LookupConcurrency > 0 {
+		group.SetLimit(s.config.LookupConcurrency)
+	}
+	for _, id := range misses {
+		group.Go(func() error {
+			tokenID, err := s.lookupTokenID(ctx, id)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[id] = err
+			} else {
+				tokenIDs[id] = tokenID
+			}
+			return nil
 		})
+	}
+	_ = group.Wait()
+	return tokenIDs, errs
+}
+
+// cachedTokenID returns the cached tokenID of id, or the NotFoundError of a device remembered without one.
+func (s *Service) cachedTokenID(id string) (tokenID uint32, found bool, err error) {
+	entry, found := s.memoryCache.get(id)
+	if !found {
+		return 0, false, nil
+	}
+	if entry.negative {
+		return 0, true, fmt.Errorf("%w: no tokenID found", NotFoundError{DeviceID: id})
+	}
+	return entry.tokenID, true, nil
+}
+
+// lookupTokenID fetches and caches the tokenID on a cache miss.
+// Concurrent lookups of the same id share a single call, made with the context of the first caller.
+// The result is not cached if SetTokenID or Invalidate is called for id while the call is in flight.
+func (s *Service) lookupTokenID(ctx context.Context, id string) (uint32, error) {
+	v, err, _ := s.lookups.Do(id, func() (any, error) {
+		if !s.breaker.allow() {
+			return uint32(0), ErrCircuitOpen
+		}
+		generation := s.beginLookup(id)
+		userDevice, err := s.getUserDevice(ctx, id)
+		if err != nil && ctx.Err() != nil {
+			// Give up on the caller's deadline without blaming or clearing the devices API.
+			s.breaker.release()
+		} else {
+			s.breaker.done(isRetryable(err))
+		}
 		if err != nil {
 			if status.Code(err) == codes.NotFound {
+				s.endLookup(id, generation, func() { s.cacheNotFound(id) })
 				notFound := fmt.Errorf("%w: no device exist", NotFoundError{DeviceID: id})
-				return 0, errors.Join(notFound, err)
+				return uint32(0), errors.Join(notFound, err)
 			}
-			return 0, err
+			s.endLookup(id, generation, nil)
+			return uint32(0), err
 		}
-		s.memoryCache.Set(fmt.Sprintf(deviceTokenCacheKey, id), userDevice, 0)
+		if userDevice.TokenId == nil {
+			// Only remember a device without a token for a short while so that a newly minted token is picked up.
+			s.endLookup(id, generation, func() { s.cacheNotFound(id) })
+			return uint32(0), fmt.Errorf("%w: no tokenID set", NotFoundError{DeviceID: id})
+		}
+		tokenID := uint32(*userDevice.TokenId)
+		s.endLookup(id, generation, func() { s.memoryCache.set(id, tokenID, false, s.config.CacheTTL) })
+		return tokenID, nil
+	})
+	return v.(uint32), err
+}
+
+// beginLookup tracks a devices API call for id and returns the generation of id it started at.
+func (s *Service) beginLookup(id string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	generation, ok := s.generations[id]
+	if !ok {
+		generation = &lookupGeneration{}
+		s.generations[id] = generation
+	}
+	generation.lookups++
+	return generation.value
+}
+
+// endLookup stops tracking a call for id started at generation and calls store, if set,
+// unless the cache entry of id was replaced since.
+func (s *Service) endLookup(id string, generation uint64, store func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.generations[id]
+	current.lookups--
+	if current.lookups == 0 {
+		delete(s.generations, id)
 	}
+	if store != nil && current.value == generation {
+		store()
+	}
+}
+
+// cacheNotFound remembers that id has no tokenID for the NotFoundTTL.
+func (s *Service) cacheNotFound(id string) {
+	s.memoryCache.set(id, 0, true, s.config.NotFoundTTL)
+}
+
+// SetTokenID caches tokenID as the tokenID of id, replacing what was looked up before.
+func (s *Service) SetTokenID(id string, tokenID uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaceEntry(id)
+	s.memoryCache.set(id, tokenID, false, s.config.CacheTTL)
+}
+
+// Invalidate drops the cached tokenID of id so that the next lookup asks the devices API.
+func (s *Service) Invalidate(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replaceEntry(id)
+	s.memoryCache.remove(id)
+}
+
+// replaceEntry keeps lookups in flight from caching their result over the new entry of id. s.mu must be held.
+func (s *Service) replaceEntry(id string) {
+	s.lookups.Forget(id)
+	if generation, ok := s.generations[id]; ok {
+		generation.value++
+	}
+}
+
+// getUserDevice calls GetUserDevice, retrying with exponential backoff while the call fails with a retryable code.
+func (s *Service) getUserDevice(ctx context.Context, id string) (*pb.UserDevice, error) {
+	deviceClient := pb.NewUserDeviceServiceClient(s.devicesConn)
+	backoff := s.config.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := ctx, context.CancelFunc(func() {})
+		if s.config.Timeout > 0 {
+			callCtx, cancel = context.WithTimeout(ctx, s.config.Timeout)
+		}
+		userDevice, err := deviceClient.GetUserDevice(callCtx, &pb.GetUserDeviceRequest{
+			Id: id,
+		})
+		cancel()
+		if err == nil || !isRetryable(err) || attempt >= s.config.MaxRetries || ctx.Err() != nil {
+			return userDevice, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff = min(2*backoff, s.config.MaxBackoff)
+	}
+}
 
-	if userDevice.TokenId == nil {
-		return 0, fmt.Errorf("%w: no tokenID set", NotFoundError{DeviceID: id})
+// isRetryable reports whether err is a transient failure of the devices API.
+func isRetryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return false
 	}
-	return uint32(*userDevice.TokenId), nil
 }
@@ -0,0 +1,588 @@
+package deviceapi
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/DIMO-Network/devices-api/pkg/grpc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeUserDeviceServer answers GetUserDevice with the queued errors and then the first tokenless calls
+// without a tokenID before returning token ID 7. Calls for the missing device fail with NotFound.
+// If release is set, calls block until it is closed.
+type fakeUserDeviceServer struct {
+	pb.UnimplementedUserDeviceServiceServer
+	mu        sync.Mutex
+	errs      []error
+	tokenless int
+	missing   string
+	delay     time.Duration
+	release   chan struct{}
+	calls     int
+}
+
+func (f *fakeUserDeviceServer) GetUserDevice(ctx context.Context, req *pb.GetUserDeviceRequest) (*pb.UserDevice, error) {
+	f.mu.Lock()
+	f.calls++
+	var err error
+	minted := true
+	if req.GetId() == f.missing {
+		err = status.Error(codes.NotFound, "no device")
+	} else if len(f.errs) > 0 {
+		err, f.errs = f.errs[0], f.errs[1:]
+	} else if f.tokenless > 0 {
+		f.tokenless--
+		minted = false
+	}
+	delay := f.delay
+	f.delay = 0
+	f.mu.Unlock()
+
+	if f.release != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-f.release:
+		}
+	}
+	if delay > 0 {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !minted {
+		return &pb.UserDevice{Id: req.GetId()}, nil
+	}
+	tokenID := uint64(7)
+	return &pb.UserDevice{Id: req.GetId(), TokenId: &tokenID}, nil
+}
+
+func (f *fakeUserDeviceServer) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// newTestService starts fake on an in-memory listener and returns a Service connected to it.
+func newTestService(t *testing.T, fake *fakeUserDeviceServer, config Config) *Service {
+	t.Helper()
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	pb.RegisterUserDeviceServiceServer(server, fake)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return NewServiceWithConfig(conn, config)
+}
+
+func TestServiceRetries(t *testing.T) {
+	config := Config{
+		Timeout:        100 * time.Millisecond,
+		MaxRetries:     2,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+	}
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+
+	tests := []struct {
+		name             string
+		errs             []error
+		delay            time.Duration
+		expectedCalls    int
+		expectedCode     codes.Code
+		expectedNotFound bool
+	}{
+		{
+			name:          "success",
+			expectedCalls: 1,
+		},
+		{
+			name:          "retried until success",
+			errs:          []error{unavailable, unavailable},
+			expectedCalls: 3,
+		},
+		{
+			name:          "retries exhausted",
+			errs:          []error{unavailable, unavailable, unavailable},
+			expectedCalls: 3,
+			expectedCode:  codes.Unavailable,
+		},
+		{
+			name:          "not retryable",
+			errs:          []error{status.Error(codes.InvalidArgument, "bad id")},
+			expectedCalls: 1,
+			expectedCode:  codes.InvalidArgument,
+		},
+		{
+			name:             "not found",
+			errs:             []error{status.Error(codes.NotFound, "no device")},
+			expectedCalls:    1,
+			expectedCode:     codes.NotFound,
+			expectedNotFound: true,
+		},
+		{
+			name:          "slow call times out and is retried",
+			delay:         time.Second,
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeUserDeviceServer{errs: tt.errs, delay: tt.delay}
+			svc := newTestService(t, fake, config)
+
+			tokenID, err := svc.TokenIDFromSubject(context.Background(), "device1")
+			require.Equal(t, tt.expectedCalls, fake.callCount())
+			if tt.expectedCode != codes.OK {
+				require.Error(t, err)
+				require.Equal(t, tt.expectedCode, status.Code(err))
+				if tt.expectedNotFound {
+					require.ErrorAs(t, err, &NotFoundError{})
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, uint32(7), tokenID)
+		})
+	}
+}
+
+func TestServiceCircuitBreaker(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	fake := &fakeUserDeviceServer{errs: []error{unavailable, unavailable, unavailable}}
+	svc := newTestService(t, fake, Config{
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+	now := time.Now()
+	svc.breaker.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	// Two failed lookups open the breaker.
+	for range 2 {
+		_, err := svc.TokenIDFromSubject(ctx, "device1")
+		require.Equal(t, codes.Unavailable, status.Code(err))
+	}
+	_, err := svc.TokenIDFromSubject(ctx, "device1")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 2, fake.callCount())
+
+	// After the cooldown a failed trial call opens the breaker again.
+	now = now.Add(time.Minute)
+	_, err = svc.TokenIDFromSubject(ctx, "device1")
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = svc.TokenIDFromSubject(ctx, "device1")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 3, fake.callCount())
+
+	// A successful trial call closes it.
+	now = now.Add(time.Minute)
+	tokenID, err := svc.TokenIDFromSubject(ctx, "device1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), tokenID)
+	_, err = svc.TokenIDFromSubject(ctx, "device2")
+	require.NoError(t, err)
+	require.Equal(t, 5, fake.callCount())
+}
+
+func TestServiceCircuitBreakerCancelledTrial(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	fake := &fakeUserDeviceServer{errs: []error{unavailable, unavailable}}
+	svc := newTestService(t, fake, Config{
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+	now := time.Now()
+	svc.breaker.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for range 2 {
+		_, err := svc.TokenIDFromSubject(ctx, "device1")
+		require.Equal(t, codes.Unavailable, status.Code(err))
+	}
+
+	// A trial call abandoned by its caller neither closes the breaker nor clears the failures.
+	now = now.Add(time.Minute)
+	fake.mu.Lock()
+	fake.delay = time.Second
+	fake.mu.Unlock()
+	callCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err := svc.TokenIDFromSubject(callCtx, "device1")
+	cancel()
+	require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	require.Eventually(t, func() bool { return fake.callCount() == 3 }, time.Second, time.Millisecond)
+
+	// The next trial call fails and opens the breaker again right away.
+	fake.mu.Lock()
+	fake.errs = []error{unavailable}
+	fake.mu.Unlock()
+	_, err = svc.TokenIDFromSubject(ctx, "device1")
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	_, err = svc.TokenIDFromSubject(ctx, "device1")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 4, fake.callCount())
+}
+
+func TestServiceCoalescesLookups(t *testing.T) {
+	fake := &fakeUserDeviceServer{release: make(chan struct{})}
+	svc := newTestService(t, fake, DefaultConfig())
+
+	const callers = 50
+	var wg sync.WaitGroup
+	tokenIDs := make([]uint32, callers)
+	errs := make([]error, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokenIDs[i], errs[i] = svc.TokenIDFromSubject(context.Background(), "device1")
+		}()
+	}
+	require.Eventually(t, func() bool { return fake.callCount() > 0 }, time.Second, time.Millisecond)
+	// Give the remaining callers time to queue up behind the call in flight.
+	time.Sleep(50 * time.Millisecond)
+	close(fake.release)
+	wg.Wait()
+
+	require.Equal(t, 1, fake.callCount())
+	for i := range callers {
+		require.NoError(t, errs[i])
+		require.Equal(t, uint32(7), tokenIDs[i])
+	}
+}
+
+func TestServiceNotFoundCache(t *testing.T) {
+	notFound := status.Error(codes.NotFound, "no device")
+
+	tests := []struct {
+		name          string
+		errs          []error
+		tokenless     int
+		notFoundTTL   time.Duration
+		wait          time.Duration
+		expectedCalls int
+	}{
+		{
+			name:          "not found is cached",
+			errs:          []error{notFound},
+			notFoundTTL:   time.Minute,
+			expectedCalls: 1,
+		},
+		{
+			name:          "no tokenID is cached",
+			tokenless:     1,
+			notFoundTTL:   time.Minute,
+			expectedCalls: 1,
+		},
+		{
+			name:          "not found without negative caching",
+			errs:          []error{notFound},
+			expectedCalls: 2,
+		},
+		{
+			name:          "no tokenID without negative caching",
+			tokenless:     1,
+			expectedCalls: 2,
+		},
+		{
+			name:          "minted after not found expired",
+			errs:          []error{notFound},
+			notFoundTTL:   20 * time.Millisecond,
+			wait:          50 * time.Millisecond,
+			expectedCalls: 2,
+		},
+		{
+			name:          "minted after no tokenID expired",
+			tokenless:     1,
+			notFoundTTL:   20 * time.Millisecond,
+			wait:          50 * time.Millisecond,
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeUserDeviceServer{errs: tt.errs, tokenless: tt.tokenless}
+			svc := newTestService(t, fake, Config{NotFoundTTL: tt.notFoundTTL})
+			ctx := context.Background()
+
+			_, err := svc.TokenIDFromSubject(ctx, "device1")
+			require.ErrorAs(t, err, &NotFoundError{})
+			time.Sleep(tt.wait)
+			tokenID, err := svc.TokenIDFromSubject(ctx, "device1")
+			require.Equal(t, tt.expectedCalls, fake.callCount())
+			if tt.expectedCalls == 1 {
+				require.ErrorAs(t, err, &NotFoundError{})
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, uint32(7), tokenID)
+		})
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	evicted := 0
+	cache := newTokenCache(2, func() { evicted++ })
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	cache.set("device1", 1, false, time.Minute)
+	cache.set("device2", 0, true, time.Second)
+	entry, ok := cache.get("device2")
+	require.True(t, ok)
+	require.True(t, entry.negative)
+
+	// device1 is used after device2, so device2 is the least recently used and evicted by device3.
+	entry, ok = cache.get("device1")
+	require.True(t, ok)
+	require.Equal(t, uint32(1), entry.tokenID)
+	cache.set("device3", 3, false, time.Minute)
+	_, ok = cache.get("device2")
+	require.False(t, ok)
+	require.Equal(t, 1, evicted)
+	require.Equal(t, 2, cache.len())
+
+	// Updating an entry does not evict.
+	cache.set("device1", 4, false, time.Minute)
+	entry, ok = cache.get("device1")
+	require.True(t, ok)
+	require.Equal(t, uint32(4), entry.tokenID)
+	require.Equal(t, 1, evicted)
+
+	// Expired entries are dropped without counting as evictions.
+	now = now.Add(time.Minute)
+	_, ok = cache.get("device1")
+	require.False(t, ok)
+	require.Equal(t, 1, cache.len())
+	require.Equal(t, 1, evicted)
+
+	// Nothing is cached for a zero ttl.
+	cache.set("device5", 5, false, 0)
+	_, ok = cache.get("device5")
+	require.False(t, ok)
+}
+
+func TestServiceCacheSize(t *testing.T) {
+	evicted := 0
+	fake := &fakeUserDeviceServer{}
+	svc := newTestService(t, fake, Config{
+		CacheTTL:  time.Minute,
+		CacheSize: 1,
+		OnEvict:   func() { evicted++ },
+	})
+	ctx := context.Background()
+
+	for _, id := range []string{"device1", "device1", "device2", "device1"} {
+		tokenID, err := svc.TokenIDFromSubject(ctx, id)
+		require.NoError(t, err)
+		require.Equal(t, uint32(7), tokenID)
+	}
+	require.Equal(t, 3, fake.callCount())
+	require.Equal(t, 2, evicted)
+}
+
+func TestServiceCacheUpdates(t *testing.T) {
+	fake := &fakeUserDeviceServer{tokenless: 1}
+	svc := newTestService(t, fake, DefaultConfig())
+	ctx := context.Background()
+
+	// A minted device replaces the remembered missing token.
+	_, err := svc.TokenIDFromSubject(ctx, "device1")
+	require.ErrorAs(t, err, &NotFoundError{})
+	svc.SetTokenID("device1", 9)
+	tokenID, err := svc.TokenIDFromSubject(ctx, "device1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(9), tokenID)
+	require.Equal(t, 1, fake.callCount())
+
+	// An invalidated device is looked up again.
+	svc.Invalidate("device1")
+	tokenID, err = svc.TokenIDFromSubject(ctx, "device1")
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), tokenID)
+	require.Equal(t, 2, fake.callCount())
+}
+
+func TestServiceCacheUpdateDuringLookup(t *testing.T) {
+	tests := []struct {
+		name            string
+		update          func(svc *Service)
+		expectedTokenID uint32
+		expectedCalls   int
+	}{
+		{
+			name:            "set token id",
+			update:          func(svc *Service) { svc.SetTokenID("device1", 9) },
+			expectedTokenID: 9,
+			expectedCalls:   1,
+		},
+		{
+			name:            "invalidate",
+			update:          func(svc *Service) { svc.Invalidate("device1") },
+			expectedTokenID: 7,
+			expectedCalls:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			fake := &fakeUserDeviceServer{release: release}
+			svc := newTestService(t, fake, DefaultConfig())
+			ctx := context.Background()
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				_, _ = svc.TokenIDFromSubject(ctx, "device1")
+			}()
+			require.Eventually(t, func() bool { return fake.callCount() > 0 }, time.Second, time.Millisecond)
+			// The update arrives while the lookup is in flight and must not be overwritten by its stale result.
+			tt.update(svc)
+			close(release)
+			<-done
+
+			tokenID, err := svc.TokenIDFromSubject(ctx, "device1")
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedTokenID, tokenID)
+			require.Equal(t, tt.expectedCalls, fake.callCount())
+			require.Empty(t, svc.generations)
+		})
+	}
+}
+
+func TestServiceSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	config := Config{CacheTTL: time.Hour, NotFoundTTL: time.Hour}
+	saved := NewServiceWithConfig(nil, config)
+	now := time.Now()
+	saved.memoryCache.now = func() time.Time { return now }
+	saved.memoryCache.set("device1", 1, false, time.Hour)
+	saved.memoryCache.set("device2", 2, false, time.Minute)
+	saved.memoryCache.set("device3", 0, true, time.Hour)
+	require.NoError(t, saved.SaveSnapshot(path))
+
+	tests := []struct {
+		name           string
+		path           string
+		config         Config
+		elapsed        time.Duration
+		maxAge         time.Duration
+		expectedLoaded int
+		expectedTTL    map[string]time.Duration
+	}{
+		{
+			name:           "fresh snapshot",
+			path:           path,
+			config:         config,
+			maxAge:         time.Hour,
+			expectedLoaded: 2,
+			expectedTTL:    map[string]time.Duration{"device1": time.Hour, "device2": time.Minute},
+		},
+		{
+			name:           "expired entries are skipped",
+			path:           path,
+			config:         config,
+			elapsed:        2 * time.Minute,
+			maxAge:         time.Hour,
+			expectedLoaded: 1,
+			expectedTTL:    map[string]time.Duration{"device1": time.Hour - 2*time.Minute},
+		},
+		{
+			name:           "ttl is capped by the cache ttl",
+			path:           path,
+			config:         Config{CacheTTL: 30 * time.Second},
+			maxAge:         time.Hour,
+			expectedLoaded: 2,
+			expectedTTL:    map[string]time.Duration{"device1": 30 * time.Second, "device2": 30 * time.Second},
+		},
+		{
+			name:           "stale snapshot",
+			path:           path,
+			config:         config,
+			elapsed:        10 * time.Minute,
+			maxAge:         5 * time.Minute,
+			expectedLoaded: 0,
+		},
+		{
+			name:           "missing snapshot",
+			path:           filepath.Join(t.TempDir(), "missing.json"),
+			config:         config,
+			maxAge:         time.Hour,
+			expectedLoaded: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := NewServiceWithConfig(nil, tt.config)
+			loadedAt := now.Add(tt.elapsed)
+			svc.memoryCache.now = func() time.Time { return loadedAt }
+			loaded, err := svc.LoadSnapshot(tt.path, tt.maxAge)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedLoaded, loaded)
+			require.Equal(t, tt.expectedLoaded, svc.memoryCache.len())
+			for id, ttl := range tt.expectedTTL {
+				entry, ok := svc.memoryCache.get(id)
+				require.True(t, ok)
+				require.False(t, entry.negative)
+				require.Equal(t, loadedAt.Add(ttl), entry.expires)
+			}
+		})
+	}
+}
+
+func TestServiceTokenIDsFromSubjects(t *testing.T) {
+	fake := &fakeUserDeviceServer{missing: "missing", release: make(chan struct{})}
+	config := DefaultConfig()
+	config.MaxRetries = 0
+	config.LookupConcurrency = 2
+	svc := newTestService(t, fake, config)
+	svc.SetTokenID("cached", 3)
+
+	done := make(chan struct{})
+	var tokenIDs map[string]uint32
+	var errs map[string]error
+	go func() {
+		defer close(done)
+		tokenIDs, errs = svc.TokenIDsFromSubjects(context.Background(), []string{"cached", "missing", "device1", "device2"})
+	}()
+	// At most two lookups are in flight at once.
+	require.Eventually(t, func() bool { return fake.callCount() == 2 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 2, fake.callCount())
+	close(fake.release)
+	<-done
+
+	require.Equal(t, 3, fake.callCount())
+	require.Len(t, errs, 1)
+	require.Equal(t, map[string]uint32{"cached": 3, "device1": 7, "device2": 7}, tokenIDs)
+	var notFound NotFoundError
+	require.ErrorAs(t, errs["missing"], &notFound)
+	require.Equal(t, "missing", notFound.DeviceID)
+}
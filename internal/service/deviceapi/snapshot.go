@@ -0,0 +1,91 @@
+package deviceapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheSnapshot is the file format of a saved cache.
+type cacheSnapshot struct {
+	SavedAt time.Time            `json:"saved_at"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+type cacheSnapshotEntry struct {
+	Subject string    `json:"subject"`
+	TokenID uint32    `json:"token_id"`
+	Expires time.Time `json:"expires"`
+}
+
+// SaveSnapshot writes the cached tokenIDs to path so that a restarted Service can start with them.
+// The file is replaced atomically. Devices without a tokenID are not saved.
+func (s *Service) SaveSnapshot(path string) error {
+	entries := s.memoryCache.snapshot()
+	snapshot := cacheSnapshot{
+		SavedAt: s.memoryCache.now(),
+		Entries: make([]cacheSnapshotEntry, len(entries)),
+	}
+	for i, entry := range entries {
+		snapshot.Entries[i] = cacheSnapshotEntry{Subject: entry.id, TokenID: entry.tokenID, Expires: entry.expires}
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal cache snapshot: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create cache snapshot: %w", err)
+	}
+	// The temporary file is already gone after a successful rename.
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write cache snapshot: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace cache snapshot: %w", err)
+	}
+	return nil
+}
+
+// LoadSnapshot fills the cache with the tokenIDs saved by SaveSnapshot and returns how many were loaded.
+// A missing file or a snapshot saved more than maxAge ago loads nothing. Loaded tokenIDs keep their
+// original expiry, shortened to the CacheTTL if that is lower now.
+func (s *Service) LoadSnapshot(path string, maxAge time.Duration) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read cache snapshot: %w", err)
+	}
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return 0, fmt.Errorf("failed to parse cache snapshot: %w", err)
+	}
+
+	now := s.memoryCache.now()
+	if now.Sub(snapshot.SavedAt) > maxAge {
+		return 0, nil
+	}
+	loaded := 0
+	// Insert from least to most recently used to keep the order if the cache is smaller than the snapshot.
+	for i := len(snapshot.Entries) - 1; i >= 0; i-- {
+		entry := snapshot.Entries[i]
+		ttl := min(entry.Expires.Sub(now), s.config.CacheTTL)
+		if ttl <= 0 {
+			continue
+		}
+		s.memoryCache.set(entry.Subject, entry.TokenID, false, ttl)
+		loaded++
+	}
+	return loaded, nil
+}